@@ -6,12 +6,17 @@ import (
 	"flag"
 	"fmt"
 	"os"
+	"regexp"
 	"strconv"
+	"strings"
 	"time"
 	"unicode"
 
 	"github.com/golang/glog"
+	"github.com/monopole/mdrip/lexer"
 	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/report"
+	"github.com/monopole/mdrip/scanner"
 )
 
 const (
@@ -57,6 +62,10 @@ while the command 'mdrip --label platitude {fileName}' emits:
 
   echo "an apple a day keeps the doctor away"
 
+and the command 'mdrip --label "foo && !bar" {fileName}' emits:
+
+  cd $HOME
+
 
 Modes:
 
@@ -80,6 +89,17 @@ Modes:
 
    Change port using --port flag.
 
+ --mode step
+
+   Shows each block (name, location and code) in the terminal, and
+   asks whether to run, skip or edit it (with $EDITOR), or to quit.
+   Blocks run one at a time in one bash subprocess, so state carries
+   from block to block, and their output is shown as it arrives.  A
+   block that exits the shell leaves a new one for the blocks that
+   follow.  The @dir attribute applies; @retry, @timeout and @waitFor
+   don't.  With markdown from stdin (-), answers are read from the
+   terminal.  Handy for walking through a tutorial, or debugging one.
+
  --mode test
 
    Use this flag for markdown-based feature tests.
@@ -95,6 +115,10 @@ Modes:
    This runs extracted blocks in an mdrip subshell, leaving the
    executing shell unchanged.
 
+   Blocks whose code fence names python, node (js), ruby or perl run
+   in a separate process of that interpreter (see --interpreter);
+   everything else runs in the subshell.
+
    In this mode, mdrip captures the stdout and stderr of the
    subprocess, reporting only blocks that fail, facilitating error
    diagnosis.
@@ -102,6 +126,46 @@ Modes:
    Normally, mdrip exits with non-zero status only when used
    incorrectly, e.g. file not found, bad flags, etc.  In in test mode,
    mdrip will exit with the status of any failing code block.
+
+   Blocks fenced as console hold a terminal session.  Each line
+   starting with a prompt (see --prompt) is a command, and the lines
+   after it, up to the next prompt, are its expected output.
+
+   A block labeled @expect, following a command block, holds the
+   output expected of that block; a block printing anything else
+   fails, with a diff.
+
+   When output changes on purpose, use --update to rewrite the
+   expected output in the markdown files with what blocks printed,
+   leaving all other text intact.  Expected lines that still match,
+   including patterns, are kept.
+
+   Use --keepGoing to find every failing block in one run.  Each
+   file then runs in its own shell, and a failure only skips the
+   rest of its file.  Blocks labeled @independent run in a shell of
+   their own.  Every failure is reported, followed by a table of all
+   blocks.
+
+   Use --report junit=results.xml to also write a JUnit XML report,
+   with a testsuite per file and a testcase per block (including
+   those skipped after a failure), for CI dashboards.  Likewise
+   --report tap writes a TAP 13 stream to stdout.  Formats may be
+   combined by repeating the flag.
+
+   Output lines may be of any length, and bytes that aren't UTF-8
+   are shown as U+FFFD.  At most --maxOutput bytes of a block's
+   stdout, and of its stderr, are kept for reports: the start and the
+   end, with a note saying how much was left out between them.
+
+   Use --json to follow a run as it happens, via newline-delimited
+   JSON events on stdout, in the manner of 'go test -json'.  Reports
+   must then be written to files.
+
+   Malformed markdown (e.g. an unclosed label comment or code fence)
+   is reported with file name, line and column in every mode, as is a
+   file that can't be read.  In test mode either also causes mdrip to
+   exit with non-zero status, since it means some blocks would go
+   untested.
 `
 )
 
@@ -112,14 +176,27 @@ const (
 	ModePrint
 	ModeTmux
 	ModeTest
+	ModeStep
 )
 
 var (
 	mode = flag.String("mode", "print",
-		`Mode is print, test or tmux.`)
+		`Mode is print, test, step or tmux.`)
 
 	label = flag.String("label", "",
-		`Using "--label foo" means extract only blocks annotated with "<!-- @foo -->".`)
+		`Using "--label foo" means extract only blocks annotated with "<!-- @foo -->".  Labels combine with &&, || and !, e.g. "--label 'lesson1 && !slow'".`)
+
+	languages = flag.String("lang", "",
+		`Using "--lang bash,sh" means extract only blocks whose code fence names one of these languages (or no language).`)
+
+	prompt = flag.String("prompt", lexer.DefaultPrompt,
+		`In blocks fenced as console (a terminal session), a regular expression matching the prompt that starts each command line.`)
+
+	include = flag.String("include", "*.md,*.markdown",
+		`For directory arguments, extract from files whose names match one of these patterns.`)
+
+	exclude = flag.String("exclude", "",
+		`Skip files and directories matching one of these patterns, e.g. "vendor,*_draft.md,docs/old/**".`)
 
 	preambled = flag.Int("preambled", 0,
 		`In --mode print, run the first {n} blocks in the current shell, and the rest in a trapped subshell.`)
@@ -131,12 +208,95 @@ var (
 		`In --mode tmux, use given port for the local web server.`)
 
 	blockTimeOut = flag.Duration("blockTimeOut", 7*time.Second,
-		`In --mode test, the max amount of time to wait for a command block to exit.`)
+		`In --mode test, the max amount of time to wait for a command block to exit, unless the block has a @timeout attribute.  Blocks that time out are killed, along with everything they started.`)
+
+	maxOutput = flag.Int("maxOutput", scanner.DefaultMaxOutput,
+		`In --mode test, the most bytes of each block's stdout, and of its stderr, to keep for reports; the middle of longer output is left out, with a note saying how much.  Zero means no limit.`)
+
+	interpreters = interpreterFlag{}
+
+	reports = &reportFlag{}
+
+	jsonEvents = flag.Bool("json", false,
+		`In --mode test, write newline-delimited JSON events (start, run, output, pass, fail, skip, end) to stdout as blocks run.`)
+
+	update = flag.Bool("update", false,
+		`In --mode test, rewrite the expected output (@expect and console blocks) of blocks that print something else with what they printed, in place.`)
+
+	keepGoing = flag.Bool("keepGoing", false,
+		`In --mode test, run each file in its own shell (and each block labeled @independent in a shell of its own), so that a failure only skips the rest of its file, then summarize every block.`)
 
 	ignoreTestFailure = flag.Bool("ignoreTestFailure", false,
 		`In --mode test, exit with success regardless of extracted code failure.`)
 )
 
+// interpreterFlag accumulates "language=command" flag values.
+type interpreterFlag map[string]string
+
+func (f interpreterFlag) String() string {
+	pairs := make([]string, 0, len(f))
+	for language, command := range f {
+		pairs = append(pairs, language+"="+command)
+	}
+	return strings.Join(pairs, ",")
+}
+
+func (f interpreterFlag) Set(value string) error {
+	i := strings.Index(value, "=")
+	if i < 1 || i == len(value)-1 {
+		return fmt.Errorf("expected language=command, got %q", value)
+	}
+	f[value[:i]] = value[i+1:]
+	return nil
+}
+
+// Report names a report format and the file to write it to; an
+// empty Path means stdout.
+type Report struct {
+	Format string
+	Path   string
+}
+
+// reportFlag accumulates "format[=path]" flag values.
+type reportFlag []Report
+
+func (f *reportFlag) String() string {
+	specs := make([]string, 0, len(*f))
+	for _, r := range *f {
+		specs = append(specs, r.Format+"="+r.Path)
+	}
+	return strings.Join(specs, ",")
+}
+
+func (f *reportFlag) Set(value string) error {
+	r := Report{Format: value}
+	if i := strings.Index(value, "="); i > -1 {
+		r = Report{value[:i], value[i+1:]}
+	}
+	if _, ok := report.Writers[r.Format]; !ok {
+		return fmt.Errorf("unknown report format %q", r.Format)
+	}
+	*f = append(*f, r)
+	return nil
+}
+
+// toStdout returns the first report to be written to stdout, if any.
+func (f *reportFlag) toStdout() *Report {
+	for i := range *f {
+		if (*f)[i].Path == "" {
+			return &(*f)[i]
+		}
+	}
+	return nil
+}
+
+func init() {
+	flag.Var(interpreters, "interpreter",
+		`In --mode test, run blocks in the given language with a command that reads code from stdin, e.g. "python=python3 -".  Repeatable.`)
+	flag.Var(reports, "report",
+		`In --mode test, write a report on every block in the given format to the given file (or stdout), e.g. "junit=results.xml" or "tap".  Repeatable.`)
+}
+
 // A forgiving interpretation of mode argument.
 func determineMode() ModeType {
 	if len(*mode) == 0 {
@@ -145,12 +305,14 @@ func determineMode() ModeType {
 	if len(*mode) < 2 {
 		return ModeUnknown
 	}
-	// Use 2nd letter since test and tmux start with t.
+	// Use 2nd letter since test, tmux and step start with t or s.
 	switch unicode.ToLower([]rune(*mode)[1]) {
 	case 'e': // test
 		return ModeTest
 	case 'm': // tmux
 		return ModeTmux
+	case 't': // step
+		return ModeStep
 	default:
 		return ModePrint
 	}
@@ -163,17 +325,30 @@ func determineLabel() model.Label {
 	return model.Label(*label)
 }
 
-func determineFiles() []model.FileName {
-	f := make([]model.FileName, flag.NArg())
-	for i, n := range flag.Args() {
-		f[i] = model.FileName(n)
+func determineLanguages() []string {
+	if len(*languages) == 0 {
+		return nil
+	}
+	return strings.Split(*languages, ",")
+}
+
+func splitPatterns(s string) []string {
+	if len(s) == 0 {
+		return nil
 	}
-	return f
+	return strings.Split(s, ",")
+}
+
+func determineFiles() ([]model.FileName, error) {
+	f := &fileFinder{splitPatterns(*include), splitPatterns(*exclude)}
+	return f.expand(flag.Args())
 }
 
 type Config struct {
 	scriptName model.Label
 	mode       ModeType
+	languages  []string
+	prompt     *regexp.Regexp
 	fileNames  []model.FileName
 }
 
@@ -181,6 +356,12 @@ func (c *Config) BlockTimeOut() time.Duration {
 	return *blockTimeOut
 }
 
+// MaxOutput is the most bytes of a block's output to keep, per
+// stream, or zero for no limit.
+func (c *Config) MaxOutput() int {
+	return *maxOutput
+}
+
 func (c *Config) Preambled() int {
 	return *preambled
 }
@@ -201,6 +382,16 @@ func (c *Config) Mode() ModeType {
 	return c.mode
 }
 
+// Update is true if a test run should rewrite expected output.
+func (c *Config) Update() bool {
+	return *update
+}
+
+// KeepGoing is true if a test run should carry on past failures.
+func (c *Config) KeepGoing() bool {
+	return *keepGoing
+}
+
 func (c *Config) IgnoreTestFailure() bool {
 	return *ignoreTestFailure
 }
@@ -209,6 +400,34 @@ func (c *Config) ScriptName() model.Label {
 	return c.scriptName
 }
 
+// Interpreters maps fence languages to commands that read code from
+// stdin, overriding mdrip's defaults.
+func (c *Config) Interpreters() map[string]string {
+	return interpreters
+}
+
+// JSONEvents is true if a test run should report its progress as a
+// stream of JSON events.
+func (c *Config) JSONEvents() bool {
+	return *jsonEvents
+}
+
+// Reports returns the reports to write after a test run.
+func (c *Config) Reports() []Report {
+	return *reports
+}
+
+// Prompt returns the pattern matching prompts in terminal sessions.
+func (c *Config) Prompt() *regexp.Regexp {
+	return c.prompt
+}
+
+// Languages returns the fence languages to extract, or nil to extract
+// blocks in any language.
+func (c *Config) Languages() []string {
+	return c.languages
+}
+
 func (c *Config) FileNames() []model.FileName {
 	return c.fileNames
 }
@@ -218,15 +437,21 @@ func GetConfig() *Config {
 	flag.Parse()
 
 	if flag.NArg() < 1 {
-		fmt.Fprintln(os.Stderr, "Must specify a file name.")
-		// TODO if file is --, read from stdin.
+		fmt.Fprintln(os.Stderr, "Must specify a file name, or - for stdin.")
 		usage()
 		os.Exit(1)
 	}
 
 	desiredMode := determineMode()
 	if desiredMode == ModeUnknown {
-		fmt.Fprintln(os.Stderr, `For mode, specify print, test or tmux.`)
+		fmt.Fprintln(os.Stderr, `For mode, specify print, test, step or tmux.`)
+		usage()
+		os.Exit(1)
+	}
+
+	desiredLabel := determineLabel()
+	if _, err := model.ParseLabelExpr(desiredLabel); err != nil {
+		fmt.Fprintln(os.Stderr, err)
 		usage()
 		os.Exit(1)
 	}
@@ -238,11 +463,75 @@ func GetConfig() *Config {
 		os.Exit(1)
 	}
 
-	return &Config{determineLabel(), desiredMode, determineFiles()}
+	if *update && desiredMode != ModeTest {
+		fmt.Fprintln(os.Stderr,
+			`Makes no sense to specify --update without --mode test.`)
+		usage()
+		os.Exit(1)
+	}
+
+	if *keepGoing && desiredMode != ModeTest {
+		fmt.Fprintln(os.Stderr,
+			`Makes no sense to specify --keepGoing without --mode test.`)
+		usage()
+		os.Exit(1)
+	}
+
+	if *jsonEvents && desiredMode != ModeTest {
+		fmt.Fprintln(os.Stderr,
+			`Makes no sense to specify --json without --mode test.`)
+		usage()
+		os.Exit(1)
+	}
+
+	if *maxOutput < 0 {
+		fmt.Fprintln(os.Stderr,
+			`The --maxOutput flag needs a number of bytes, or zero for no limit.`)
+		usage()
+		os.Exit(1)
+	}
+
+	if len(*reports) > 0 && desiredMode != ModeTest {
+		fmt.Fprintln(os.Stderr,
+			`Makes no sense to specify --report without --mode test.`)
+		usage()
+		os.Exit(1)
+	}
+
+	if r := reports.toStdout(); r != nil && *jsonEvents {
+		fmt.Fprintf(os.Stderr,
+			"Makes no sense to write both --json events and a %s report to stdout; try --report %s=<file>.\n",
+			r.Format, r.Format)
+		usage()
+		os.Exit(1)
+	}
+
+	desiredPrompt, err := lexer.NewPrompt(*prompt)
+	if err != nil {
+		fmt.Fprintf(os.Stderr, "Bad --prompt: %v\n", err)
+		usage()
+		os.Exit(1)
+	}
+
+	fileNames, err := determineFiles()
+	if err != nil {
+		fmt.Fprintln(os.Stderr, err)
+		os.Exit(1)
+	}
+	if len(fileNames) < 1 {
+		fmt.Fprintln(os.Stderr, "No markdown files found.")
+		os.Exit(1)
+	}
+
+	return &Config{
+		desiredLabel, desiredMode, determineLanguages(), desiredPrompt, fileNames}
 }
 
 func usage() {
 	fmt.Fprintf(os.Stderr, "\nUsage:  %s {fileName}...\n", os.Args[0])
+	fmt.Fprint(os.Stderr, "\nA fileName of - means read markdown from stdin.\n")
+	fmt.Fprint(os.Stderr, "A directory means all markdown files below it (see --include).\n")
+	fmt.Fprint(os.Stderr, "A glob pattern, e.g. 'docs/**/*.md', means the files it matches.\n")
 	fmt.Fprint(os.Stderr, usageText)
 	fmt.Fprint(os.Stderr, "\n\nFlags:\n\n")
 	flag.PrintDefaults()
@@ -0,0 +1,200 @@
+package config
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// fileFinder expands file name arguments into markdown file names.
+type fileFinder struct {
+	include []string // Base name patterns for files found in directories.
+	exclude []string // Patterns for files and directories to skip.
+}
+
+// expand converts arguments to file names, in a deterministic order.
+//
+// A directory argument yields the files below it matching an include
+// pattern, in lexical order.  An argument holding glob characters is
+// a pattern, where "**" matches any number of directories, yielding
+// matching files in lexical order.  Anything else, including "-"
+// (stdin) and files that don't exist, is taken as is, so that files
+// that can't be read are reported with the rest of the markdown's
+// problems.  Files and directories matching an exclude pattern are
+// skipped, though the directories named by an argument itself never
+// are, and no file is listed twice.
+func (f *fileFinder) expand(args []string) ([]model.FileName, error) {
+	result := []model.FileName{}
+	seen := map[string]bool{}
+	add := func(n string) {
+		if !seen[n] {
+			seen[n] = true
+			result = append(result, model.FileName(n))
+		}
+	}
+	for _, arg := range args {
+		if arg == "-" {
+			add(arg)
+			continue
+		}
+		var found []string
+		var err error
+		if hasMeta(arg) {
+			found, err = f.glob(arg)
+		} else if info, statErr := os.Stat(arg); statErr == nil && info.IsDir() {
+			found, err = f.walk(arg, func(path string) bool {
+				return matchesAny(f.include, filepath.Base(path))
+			})
+		} else if !f.isExcluded(filepath.Dir(arg), arg) {
+			found = []string{arg}
+		}
+		if err != nil {
+			return nil, err
+		}
+		for _, n := range found {
+			add(n)
+		}
+	}
+	return result, nil
+}
+
+// glob returns the files matching the pattern.  Only a pattern
+// holding "**" is matched against the whole tree below the longest
+// leading path that holds no pattern; any other matches paths of its
+// own depth, so only the directories it names are read.
+func (f *fileFinder) glob(pattern string) ([]string, error) {
+	pattern = filepath.Clean(pattern)
+	patternSegments := strings.Split(filepath.ToSlash(pattern), "/")
+	// Work from the longest leading path that holds no pattern.
+	rootSegments := patternSegments
+	for i, s := range patternSegments {
+		if hasMeta(s) {
+			rootSegments = patternSegments[:i]
+			break
+		}
+	}
+	root := filepath.FromSlash(strings.Join(rootSegments, "/"))
+	if root == "" {
+		root = "."
+		if filepath.IsAbs(pattern) {
+			root = string(filepath.Separator)
+		}
+	}
+	var found []string
+	var err error
+	if strings.Contains("/"+strings.Join(patternSegments, "/")+"/", "/**/") {
+		found, err = f.walk(root, func(path string) bool {
+			return matchSegments(patternSegments, strings.Split(filepath.ToSlash(path), "/"))
+		})
+	} else {
+		found, err = f.globLevel(root, pattern)
+	}
+	if err == nil && len(found) == 0 {
+		err = fmt.Errorf("no files match %q", pattern)
+	}
+	return found, err
+}
+
+// globLevel returns the files matching a pattern without "**" that
+// aren't excluded below root.
+func (f *fileFinder) globLevel(root, pattern string) ([]string, error) {
+	matches, err := filepath.Glob(pattern)
+	if err != nil {
+		return nil, err
+	}
+	found := []string{}
+	for _, path := range matches {
+		info, err := os.Lstat(path)
+		if err == nil && info.Mode().IsRegular() && !f.isExcluded(root, path) {
+			found = append(found, path)
+		}
+	}
+	sort.Strings(found)
+	return found, nil
+}
+
+// walk returns files below root that aren't excluded and satisfy want.
+func (f *fileFinder) walk(root string, want func(string) bool) ([]string, error) {
+	found := []string{}
+	err := filepath.Walk(root, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+		if path != root && f.isExcluded(root, path) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+		if info.Mode().IsRegular() && want(path) {
+			found = append(found, path)
+		}
+		return nil
+	})
+	sort.Strings(found)
+	return found, err
+}
+
+// isExcluded is true if the path, found below root, matches an
+// exclude pattern.  A pattern holding a slash must match the whole
+// path; any other pattern need only match one element of the path
+// below root, so the names of root and its parents never count.
+func (f *fileFinder) isExcluded(root, path string) bool {
+	segments := strings.Split(filepath.ToSlash(filepath.Clean(path)), "/")
+	below := segments
+	if rel, err := filepath.Rel(root, path); err == nil {
+		below = strings.Split(filepath.ToSlash(rel), "/")
+	}
+	for _, p := range f.exclude {
+		if strings.Contains(p, "/") {
+			if matchSegments(strings.Split(filepath.ToSlash(filepath.Clean(p)), "/"), segments) {
+				return true
+			}
+		} else if matchesAny([]string{p}, below...) {
+			return true
+		}
+	}
+	return false
+}
+
+// matchesAny is true if any name matches any of the patterns.
+func matchesAny(patterns []string, names ...string) bool {
+	for _, p := range patterns {
+		for _, n := range names {
+			if ok, _ := filepath.Match(p, n); ok {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// matchSegments matches a slash-separated path against a pattern,
+// both split into segments.  A "**" pattern segment matches zero or
+// more path segments.
+func matchSegments(pattern, path []string) bool {
+	if len(pattern) == 0 {
+		return len(path) == 0
+	}
+	if pattern[0] == "**" {
+		for i := 0; i <= len(path); i++ {
+			if matchSegments(pattern[1:], path[i:]) {
+				return true
+			}
+		}
+		return false
+	}
+	if len(path) == 0 {
+		return false
+	}
+	ok, _ := filepath.Match(pattern[0], path[0])
+	return ok && matchSegments(pattern[1:], path[1:])
+}
+
+func hasMeta(s string) bool {
+	return strings.ContainsAny(s, "*?[")
+}
@@ -0,0 +1,105 @@
+package config
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+
+	"github.com/monopole/mdrip/model"
+)
+
+func TestExpand(t *testing.T) {
+	root, err := ioutil.TempDir("", "mdrip-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	for _, n := range []string{
+		"z.md", "a.md", "notes.txt", "b/c.markdown", "b/d.md",
+		"b/old/e.md", "vendor/f.md", "g_draft.md"} {
+		path := filepath.Join(root, n)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte("hey"), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+	in := func(names ...string) []model.FileName {
+		result := []model.FileName{}
+		for _, n := range names {
+			result = append(result, model.FileName(filepath.Join(root, n)))
+		}
+		return result
+	}
+	tests := []struct {
+		name    string
+		args    []string
+		exclude []string
+		want    []model.FileName
+	}{
+		{"dir", []string{root}, nil,
+			in("a.md", "b/c.markdown", "b/d.md", "b/old/e.md", "g_draft.md", "vendor/f.md", "z.md")},
+		{"exclude", []string{root}, []string{"vendor", "*_draft.md", filepath.Join(root, "b/old/**")},
+			in("a.md", "b/c.markdown", "b/d.md", "z.md")},
+		{"glob", []string{filepath.Join(root, "b/**/*.md")}, nil,
+			in("b/d.md", "b/old/e.md")},
+		{"levelGlob", []string{filepath.Join(root, "*.md")}, []string{"*_draft.md"},
+			in("a.md", "z.md")},
+		{"excludedNameInRoot", []string{filepath.Join(root, "b")}, []string{"b", filepath.Base(root)},
+			in("b/c.markdown", "b/d.md", "b/old/e.md")},
+		{"excludedNameInGlobRoot", []string{filepath.Join(root, "b/*.md")}, []string{"b"},
+			in("b/d.md")},
+		{"orderAndDuplicates", []string{filepath.Join(root, "z.md"), "-", root}, []string{"b"},
+			append(append(in("z.md"), "-"), in("a.md", "g_draft.md", "vendor/f.md")...)},
+	}
+	for _, test := range tests {
+		f := &fileFinder{[]string{"*.md", "*.markdown"}, test.exclude}
+		got, err := f.expand(test.args)
+		if err != nil {
+			t.Errorf("%s: unexpected error %v", test.name, err)
+			continue
+		}
+		if !reflect.DeepEqual(got, test.want) {
+			t.Errorf("%s:\ngot\n\t%v\nwant\n\t%v", test.name, got, test.want)
+		}
+	}
+
+	f := &fileFinder{[]string{"*.md"}, nil}
+	if _, err := f.expand([]string{filepath.Join(root, "**/*.rst")}); err == nil {
+		t.Errorf("expected an error for a glob matching nothing")
+	}
+	// Reload reports files that can't be read.
+	got, err := f.expand([]string{filepath.Join(root, "nope.md")})
+	if err != nil || !reflect.DeepEqual(got, in("nope.md")) {
+		t.Errorf("got %v, %v for a missing file, want it taken as is", got, err)
+	}
+}
+
+func TestExpandLevelGlob(t *testing.T) {
+	if os.Geteuid() == 0 {
+		t.Skip("root can read any directory")
+	}
+	root, err := ioutil.TempDir("", "mdrip-files-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(root)
+	if err := ioutil.WriteFile(filepath.Join(root, "a.md"), []byte("hey"), 0644); err != nil {
+		t.Fatal(err)
+	}
+	locked := filepath.Join(root, "locked")
+	if err := os.Mkdir(locked, 0); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(locked, 0755)
+	// Only "**" patterns look below the pattern's own level.
+	f := &fileFinder{[]string{"*.md"}, nil}
+	got, err := f.expand([]string{filepath.Join(root, "*.md")})
+	if err != nil || len(got) != 1 {
+		t.Errorf("got %v, %v, want just a.md", got, err)
+	}
+	if _, err := f.expand([]string{filepath.Join(root, "**/*.md")}); err == nil {
+		t.Errorf("expected an error reading %s", locked)
+	}
+}
@@ -0,0 +1,53 @@
+package lexer
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"unicode/utf8"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// Error describes a problem found while lexing markdown, and where
+// it was found.
+type Error struct {
+	FileName model.FileName
+	Line     int // 1-based line number.
+	Column   int // 1-based column number, counting runes.
+	Msg      string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("%s:%d:%d: %s", e.FileName, e.Line, e.Column, e.Msg)
+}
+
+// ErrorList is a list of lexing problems, in the order found.
+type ErrorList []*Error
+
+func (l ErrorList) Error() string {
+	var b bytes.Buffer
+	for i, e := range l {
+		if i > 0 {
+			b.WriteString("\n")
+		}
+		b.WriteString(e.Error())
+	}
+	return b.String()
+}
+
+// Err returns nil if the list is empty, else the list itself.
+func (l ErrorList) Err() error {
+	if len(l) == 0 {
+		return nil
+	}
+	return l
+}
+
+// lineAndColumn converts an offset in the input to a line and column.
+func lineAndColumn(input string, pos position) (line, column int) {
+	prefix := input[:pos]
+	line = 1 + strings.Count(prefix, "\n")
+	column = 1 + utf8.RuneCountInString(prefix[strings.LastIndex(prefix, "\n")+1:])
+	return
+}
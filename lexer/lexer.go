@@ -6,10 +6,14 @@
 package lexer
 
 import (
+	"bytes"
 	"fmt"
-	"github.com/monopole/mdrip/model"
+	"regexp"
 	"strings"
+	"time"
 	"unicode/utf8"
+
+	"github.com/monopole/mdrip/model"
 )
 
 type position int
@@ -17,15 +21,18 @@ type position int
 type itemType int
 
 const (
-	itemError        itemType = iota
-	itemBlockLabel            // Label for a command block
-	itemCommandBlock          // All lines between codeFence marks
+	itemError          itemType = iota
+	itemBlockLabel              // Label for a command block
+	itemBlockAttribute          // Attribute (key=value) for a command block
+	itemLanguage                // Language named after an opening code fence
+	itemCommandBlock            // All lines between code fences
 	itemEOF
 )
 
 type item struct {
 	typ itemType // Type of this item.
 	val string   // The value of this item.
+	pos position // Offset of this item in the input.
 }
 
 func (i item) String() string {
@@ -34,7 +41,7 @@ func (i item) String() string {
 		return "EOF"
 	case i.typ == itemError:
 		return i.val
-	case i.typ == itemBlockLabel:
+	case i.typ == itemBlockLabel || i.typ == itemBlockAttribute:
 		return string(labelMarker) + i.val
 	case i.typ == itemCommandBlock:
 		return "--------\n" + i.val + "--------\n"
@@ -45,10 +52,15 @@ func (i item) String() string {
 }
 
 const (
-	labelMarker  = '@'
-	commentOpen  = "<!--"
-	commentClose = "-->"
-	codeFence    = "```"
+	labelMarker     = '@'
+	attributeMarker = '='
+	commentOpen     = "<!--"
+	commentClose    = "-->"
+	backtick        = '`'
+	tilde           = '~'
+
+	minFenceLength = 3
+	legacyFence    = "```" // Ends a block it opened even within a line.
 )
 
 const eof = -1
@@ -60,6 +72,7 @@ type lexer struct {
 	state   stateFn   // the next lexing function to enter
 	current position  // current position in 'input'
 	start   position  // start of this item
+	opener  position  // start of the current comment or code fence
 	width   position  // width of last rune read
 	items   chan item // channel of scanned items
 }
@@ -87,7 +100,7 @@ func (l *lexer) backup() {
 }
 
 func (l *lexer) emit(t itemType) {
-	l.items <- item{t, l.input[l.start:l.current]}
+	l.items <- item{t, l.input[l.start:l.current], l.start}
 	l.start = l.current
 }
 
@@ -114,14 +127,58 @@ func (l *lexer) acceptRun(valid string) {
 }
 
 func (l *lexer) acceptWord() {
-	l.acceptRun("012345789abcdefghijklmnopqrstuvwxyz_ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+	l.acceptRun("0123456789abcdefghijklmnopqrstuvwxyz_ABCDEFGHIJKLMNOPQRSTUVWXYZ")
+}
+
+// acceptValue consumes an attribute value, i.e. everything up to
+// white space or a comment closer, reporting if it consumed anything.
+// The pattern in a readiness condition like "stdout:/Listening on/"
+// may hold white space.
+func (l *lexer) acceptValue() bool {
+	start := l.current
+	inPattern := false
+	for {
+		if !inPattern && strings.HasPrefix(l.input[l.current:], commentClose) {
+			break
+		}
+		r := l.next()
+		if r == eof || isEndOfLine(r) || (isSpace(r) && !inPattern) {
+			l.backup()
+			break
+		}
+		if r == '/' && (inPattern || l.input[start:l.current] == model.ReadyStdout+":/") {
+			inPattern = !inPattern
+		}
+	}
+	return l.current > start
 }
 
-// errorf returns an error token and terminates the scan by passing
-// back a nil pointer that will be the next state, terminating l.nextItem.
+// acceptQuoted consumes the rest of a double-quoted attribute value,
+// whose opening quote has been consumed, reporting if the closing
+// quote was found on the same line.  The value may hold white space,
+// e.g. a directory name, but not a double quote.
+func (l *lexer) acceptQuoted() bool {
+	for {
+		switch r := l.next(); {
+		case r == '"':
+			return true
+		case r == eof || isEndOfLine(r):
+			l.backup()
+			return false
+		}
+	}
+}
+
+// errorf emits an error token positioned at the start of the current
+// item, then skips the rest of the line so that lexing can resume.
 func (l *lexer) errorf(format string, args ...interface{}) stateFn {
-	l.items <- item{itemError, fmt.Sprintf(format, args...)}
-	return nil
+	l.errorAt(l.start, format, args...)
+	return lexSkipLine
+}
+
+// errorAt emits an error token positioned at pos.
+func (l *lexer) errorAt(pos position, format string, args ...interface{}) {
+	l.items <- item{itemError, fmt.Sprintf(format, args...), pos}
 }
 
 // nextItem returns the next item from the input.
@@ -161,16 +218,35 @@ func lexText(l *lexer) stateFn {
 			return lexPutativeComment
 		}
 		if l.next() == eof {
-			l.ignore()
-			l.emit(itemEOF)
-			return nil
+			return lexEOF
 		}
 	}
 }
 
+// lexEOF emits the final item.
+func lexEOF(l *lexer) stateFn {
+	l.current = position(len(l.input))
+	l.ignore()
+	l.emit(itemEOF)
+	return nil
+}
+
+// lexSkipLine discards everything up to and including the next end
+// of line, allowing recovery from an error.
+func lexSkipLine(l *lexer) stateFn {
+	i := strings.Index(l.input[l.current:], "\n")
+	if i < 0 {
+		return lexEOF
+	}
+	l.current += position(i + 1)
+	l.ignore()
+	return lexText
+}
+
 // Move to lexing a command block intended for a particular script, or to
 // lexing a simple comment.  Comment opener known to be present.
 func lexPutativeComment(l *lexer) stateFn {
+	l.opener = l.current
 	l.current += position(len(commentOpen))
 	for {
 		switch r := l.next(); {
@@ -191,29 +267,45 @@ func lexPutativeComment(l *lexer) stateFn {
 func lexCommentRemainder(l *lexer) stateFn {
 	i := strings.Index(l.input[l.current:], commentClose)
 	if i < 0 {
-		return l.errorf("unclosed comment")
+		// Nothing after an unclosed comment can be lexed.
+		l.errorAt(l.opener, "unclosed comment")
+		return lexEOF
 	}
 	l.current += position(i + len(commentClose))
 	l.ignore()
 	return lexText
 }
 
-// lexBlockLabels scans a string like "@1 @hey" emitting the labels
-// "1" and "hey".  LabelMarker known to be present.
+// lexBlockLabels scans a string like "@1 @hey @timeout=5s" emitting
+// the labels "1" and "hey", and the attribute "timeout=5s".  A value
+// in double quotes, as in @dir="my dir", may hold white space.
+// LabelMarker known to be present.
 func lexBlockLabels(l *lexer) stateFn {
 	for {
 		switch r := l.next(); {
 		case r == eof || isEndOfLine(r):
+			l.backup()
 			return l.errorf("unclosed block label sequence")
 		case isSpace(r):
 			l.ignore()
 		case r == labelMarker:
 			l.ignore()
 			l.acceptWord()
-			if l.width == 0 {
+			if l.current == l.start {
 				return l.errorf("empty block label")
 			}
-			l.emit(itemBlockLabel)
+			if !l.accept(string(attributeMarker)) {
+				l.emit(itemBlockLabel)
+				break
+			}
+			if l.accept(`"`) {
+				if !l.acceptQuoted() {
+					return l.errorf("unclosed quote in block attribute value")
+				}
+			} else if !l.acceptValue() {
+				return l.errorf("empty value for block attribute")
+			}
+			l.emit(itemBlockAttribute)
 		default:
 			l.backup()
 			if !strings.HasPrefix(l.input[l.current:], commentClose) {
@@ -225,44 +317,155 @@ func lexBlockLabels(l *lexer) stateFn {
 			l.ignore()
 			r := l.next()
 			if r != '\n' && r != '\r' {
-				return l.errorf("Expected command block marker at start of line.")
+				return l.errorf("expected command block marker at start of line")
+			}
+			if r == '\r' {
+				l.accept("\n")
 			}
 			l.ignore()
-			if !strings.HasPrefix(l.input[l.current:], codeFence) {
-				return l.errorf("Expected command block mark, got: " + l.input[l.current:])
+			if fenceAt(strings.TrimLeft(l.input[l.current:], " \t")) == "" {
+				return l.errorf("expected command block marker after block labels")
 			}
 			return lexCommandBlock
 		}
 	}
 }
 
-// lexCommandBlock scans a command block.  Initial marker known to be present.
+// fenceAt returns the code fence (a run of at least three backticks
+// or tildes) at the start of s, or the empty string if there is none.
+func fenceAt(s string) string {
+	if len(s) == 0 || (s[0] != backtick && s[0] != tilde) {
+		return ""
+	}
+	n := 1
+	for n < len(s) && s[n] == s[0] {
+		n++
+	}
+	if n < minFenceLength {
+		return ""
+	}
+	return s[:n]
+}
+
+// isClosingFence is true if the line closes a block opened with the
+// given fence, indented by the given amount, i.e. holds, after at
+// most three more characters of indentation, a fence of the same
+// character at least as long as the opening fence, and nothing else.
+func isClosingFence(line, opening string, indent int) bool {
+	trimmed := strings.TrimLeft(line, " \t")
+	if len(line)-len(trimmed) > indent+3 {
+		return false
+	}
+	line = trimmed
+	closing := fenceAt(line)
+	return len(closing) >= len(opening) && closing[0] == opening[0] &&
+		strings.TrimSpace(line[len(closing):]) == ""
+}
+
+// dedent removes up to n characters of leading white space from line.
+func dedent(line string, n int) string {
+	i := 0
+	for i < n && i < len(line) && (line[i] == ' ' || line[i] == '\t') {
+		i++
+	}
+	return line[i:]
+}
+
+// lexCommandBlock scans a fenced command block.  The opening fence is
+// known to be present, possibly indented, e.g. inside a list item.
+// The block ends at a matching closing fence on a line of its own, and
+// the fence's indentation is removed from each line of code.  As ever,
+// a plain ``` fence appearing within a line of code also ends a block
+// it opened, which then holds the code preceding it; tilde and longer
+// fences, being newer, needn't carry that quirk.  Empty blocks are
+// emitted too, so that their labels don't carry over to the next
+// block.
 func lexCommandBlock(l *lexer) stateFn {
-	l.current += position(len(codeFence))
+	l.opener = l.current
+	l.acceptRun(" \t")
+	indent := int(l.current - l.opener)
+	fence := fenceAt(l.input[l.current:])
+	l.current += position(len(fence))
+	l.acceptRun(" \t")
 	l.ignore()
-	// Ignore any language specifier.
-	if idx := strings.Index(l.input[l.current:], "\n"); idx > -1 {
-		l.current += position(idx) + 1
-		l.ignore()
+	// The first word of the info string names the language.
+	for r := l.next(); r != eof && !isSpace(r) && !isEndOfLine(r); r = l.next() {
 	}
-	for {
-		if strings.HasPrefix(l.input[l.current:], codeFence) {
-			if l.current > l.start {
-				l.emit(itemCommandBlock)
-			}
-			l.current += position(len(codeFence))
+	l.backup()
+	if l.current > l.start {
+		l.emit(itemLanguage)
+	}
+	// Ignore the rest of the info string.
+	idx := strings.Index(l.input[l.current:], "\n")
+	if idx < 0 {
+		l.errorAt(l.opener, "unclosed command block")
+		return lexEOF
+	}
+	l.current += position(idx) + 1
+	l.ignore()
+	var code bytes.Buffer
+	for int(l.current) < len(l.input) {
+		line := l.input[l.current:]
+		if idx := strings.Index(line, "\n"); idx > -1 {
+			line = line[:idx+1]
+		}
+		if isClosingFence(line, fence, indent) {
+			l.items <- item{itemCommandBlock, code.String(), l.start}
+			l.current += position(len(line))
 			l.ignore()
 			return lexText
 		}
-		if l.next() == eof {
-			return l.errorf("unclosed command block")
+		if i := strings.Index(line, fence); i > -1 && fence == legacyFence {
+			code.WriteString(dedent(line[:i], indent))
+			l.items <- item{itemCommandBlock, code.String(), l.start}
+			l.current += position(i + len(fence))
+			l.ignore()
+			return lexText
+		}
+		code.WriteString(dedent(line, indent))
+		l.current += position(len(line))
+	}
+	l.errorAt(l.opener, "unclosed command block")
+	return lexEOF
+}
+
+// sleepFor returns how long to sleep after a block with the given
+// labels and attributes, or zero.
+func sleepFor(labels []model.Label, attributes map[string]string) time.Duration {
+	if v, ok := attributes[model.AttrSleep]; ok {
+		d, _ := time.ParseDuration(v)
+		return d
+	}
+	if hasLabel(labels, "sleep") {
+		return 2 * time.Second
+	}
+	return 0
+}
+
+// lastLine returns the number of the last markdown line holding the
+// given code, which starts on line first.  The code may have been
+// dedented, but keeps its line breaks.  Its last line lacks one if the
+// closing fence followed it on the same line.
+func lastLine(first int, code string) int {
+	return first + strings.Count(strings.TrimSuffix(code, "\n"), "\n")
+}
+
+// indentOf returns the whitespace starting the given line (1-based)
+// of s, e.g. that of the fence opening a block.
+func indentOf(s string, line int) string {
+	for ; line > 1; line-- {
+		i := strings.Index(s, "\n")
+		if i < 0 {
+			return ""
 		}
+		s = s[i+1:]
 	}
+	return s[:len(s)-len(strings.TrimLeft(s, " \t"))]
 }
 
-func shouldSleep(labels []model.Label) bool {
+func hasLabel(labels []model.Label, label model.Label) bool {
 	for _, l := range labels {
-		if l == "sleep" {
+		if l == label {
 			return true
 		}
 	}
@@ -277,37 +480,141 @@ func freshLabels() []model.Label {
 // CommandBlock array.  The labels are the strings after a labelMarker in
 // a comment preceding a command block.  Arrays hold command blocks in the
 // order they appeared in the input.
-func Parse(s string) (result map[model.Label][]*model.CommandBlock) {
-	result = make(map[model.Label][]*model.CommandBlock)
+//
+// Lexing continues past malformed input, so the returned error, if
+// non-nil, is an ErrorList describing every problem found in the named
+// file, and the mapping holds every block that could be recovered.
+//
+// Blocks holding a terminal session (e.g. fenced as console) are split
+// into a block per command, recognized by DefaultPrompt.
+func Parse(fileName model.FileName, s string) (map[model.Label][]*model.CommandBlock, error) {
+	prompt, _ := NewPrompt(DefaultPrompt)
+	return ParseWithPrompt(fileName, s, prompt)
+}
+
+// ParseWithPrompt is Parse, recognizing commands in terminal sessions
+// by the given prompt (see NewPrompt).  Each command is expected to
+// print the lines following it, up to the next prompt.
+func ParseWithPrompt(fileName model.FileName, s string,
+	prompt *regexp.Regexp) (map[model.Label][]*model.CommandBlock, error) {
+	result := make(map[model.Label][]*model.CommandBlock)
+	var errs ErrorList
 	currentLabels := freshLabels()
+	currentAttributes := map[string]string{}
+	language := ""
+	var previous *model.CommandBlock // Block an @expect block would follow.
 	l := newLex(s)
 	for {
 		item := l.nextItem()
 		switch {
-		case item.typ == itemEOF || item.typ == itemError:
-			return
+		case item.typ == itemEOF:
+			return result, errs.Err()
+		case item.typ == itemError:
+			line, column := lineAndColumn(s, item.pos)
+			errs = append(errs, &Error{fileName, line, column, item.val})
+			// Labels preceding a malformed construct apply to nothing.
+			previous = nil
+			currentLabels = freshLabels()
+			currentAttributes = map[string]string{}
+			language = ""
 		case item.typ == itemBlockLabel:
 			currentLabels = append(currentLabels, model.Label(item.val))
+		case item.typ == itemBlockAttribute:
+			i := strings.IndexRune(item.val, attributeMarker)
+			key, value := item.val[:i], item.val[i+1:]
+			if strings.HasPrefix(value, `"`) {
+				// See acceptQuoted.
+				value = value[1 : len(value)-1]
+			}
+			if err := model.ValidateAttribute(key, value); err != nil {
+				line, column := lineAndColumn(s, item.pos)
+				errs = append(errs, &Error{fileName, line, column, err.Error()})
+				break
+			}
+			currentAttributes[key] = value
+		case item.typ == itemLanguage:
+			language = item.val
+		case item.typ == itemCommandBlock && hasLabel(currentLabels, model.ExpectLabel):
+			first, _ := lineAndColumn(s, item.pos)
+			last := lastLine(first, item.val)
+			if item.val == "" {
+				// No output is expected.  The range is empty, just
+				// before the closing fence, where --update would put
+				// any output.
+				last = first - 1
+			}
+			if previous == nil {
+				errs = append(errs, &Error{fileName, first, 1,
+					"@expect block doesn't follow a command block"})
+			} else {
+				previous.SetExpectation(model.NewExpectation(item.val).SetSource(
+					fileName, first, last).
+					SetIndent(indentOf(s, first-1)))
+			}
+			previous = nil
+			currentLabels = freshLabels()
+			currentAttributes = map[string]string{}
+			language = ""
+		case item.typ == itemCommandBlock && item.val == "":
+			// An empty block has nothing to run.
+			previous = nil
+			currentLabels = freshLabels()
+			currentAttributes = map[string]string{}
+			language = ""
 		case item.typ == itemCommandBlock:
 			// Always add AnyLabel at the end, so one can extract all blocks.
 			currentLabels = append(currentLabels, model.AnyLabel)
-			// If the command block has a 'sleep' label, add a brief sleep
-			// at the end.  This is hack to give servers placed in the
+			first, _ := lineAndColumn(s, item.pos)
+			last := lastLine(first, item.val)
+			// If the command block has a 'sleep' label or attribute, add a
+			// sleep at the end.  This is hack to give servers placed in the
 			// background time to start.
-			if shouldSleep(currentLabels) {
-				item.val = item.val + "sleep 2s # Added by mdrip\n"
+			sleep := ""
+			if d := sleepFor(currentLabels, currentAttributes); d > 0 {
+				sleep = fmt.Sprintf("sleep %g # Added by mdrip\n", d.Seconds())
+				if !strings.HasSuffix(item.val, "\n") {
+					sleep = "\n" + sleep
+				}
 			}
-			newBlock := model.NewCommandBlock(currentLabels, item.val)
-			for _, label := range currentLabels {
-				blocks, ok := result[label]
-				if ok {
-					blocks = append(blocks, newBlock)
-				} else {
-					blocks = []*model.CommandBlock{newBlock}
+			var newBlocks []*model.CommandBlock
+			if transcriptLanguages[language] {
+				// Each command in a terminal session is a block, expected
+				// to print the output that follows it.
+				commands := splitTranscript(item.val, prompt)
+				for i, c := range commands {
+					if i == len(commands)-1 {
+						c.code += sleep
+					}
+					newBlocks = append(newBlocks, model.NewCommandBlock(currentLabels, c.code).
+						SetSource(fileName, first+c.first, first+c.last).
+						SetExpectation(model.NewExpectation(c.output).SetSource(
+							fileName, first+c.outputFirst, first+c.outputLast).
+							SetIndent(indentOf(s, first-1))))
+				}
+			} else {
+				newBlocks = append(newBlocks, model.NewCommandBlock(
+					currentLabels, item.val+sleep).SetSource(fileName, first, last))
+			}
+			previous = nil
+			for _, newBlock := range newBlocks {
+				newBlock.SetLanguage(language)
+				for key, value := range currentAttributes {
+					newBlock.SetAttribute(key, value)
+				}
+				for _, label := range currentLabels {
+					blocks, ok := result[label]
+					if ok {
+						blocks = append(blocks, newBlock)
+					} else {
+						blocks = []*model.CommandBlock{newBlock}
+					}
+					result[label] = blocks
 				}
-				result[label] = blocks
+				previous = newBlock
 			}
 			currentLabels = freshLabels()
+			currentAttributes = map[string]string{}
+			language = ""
 		}
 	}
 }
@@ -2,7 +2,10 @@ package lexer
 
 import (
 	"fmt"
+	"strings"
 	"testing"
+
+	"github.com/monopole/mdrip/model"
 )
 
 type lexTest struct {
@@ -18,7 +21,7 @@ const (
 )
 
 var (
-	tEOF = item{itemEOF, ""}
+	tEOF = item{typ: itemEOF, val: ""}
 )
 
 var lexTests = []lexTest{
@@ -29,26 +32,126 @@ var lexTests = []lexTest{
 	{"comment2", "a <!-- --> b", []item{tEOF}},
 	{"block1", "aa <!-- @1 -->\n" +
 		"```\n" + block1 + "```\n bbb",
-		[]item{{itemBlockLabel, "1"},
-			{itemCommandBlock, block1},
+		[]item{{typ: itemBlockLabel, val: "1"},
+			{typ: itemCommandBlock, val: block1},
 			tEOF}},
 	{"block2", "aa <!-- @1 @2-->\n" +
 		"```\n" + block1 + "```\n bb cc\n" +
 		"dd <!-- @3 @4-->\n" +
 		"```\n" + block2 + "```\n ee ff\n",
 		[]item{
-			{itemBlockLabel, "1"},
-			{itemBlockLabel, "2"},
-			{itemCommandBlock, block1},
-			{itemBlockLabel, "3"},
-			{itemBlockLabel, "4"},
-			{itemCommandBlock, block2},
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemBlockLabel, val: "2"},
+			{typ: itemCommandBlock, val: block1},
+			{typ: itemBlockLabel, val: "3"},
+			{typ: itemBlockLabel, val: "4"},
+			{typ: itemCommandBlock, val: block2},
 			tEOF}},
 	{"blockWithLangName", "Hello <!-- @1 -->\n" +
 		"```java\nvoid main whatever\n```",
 		[]item{
-			{itemBlockLabel, "1"},
-			{itemCommandBlock, "void main whatever\n"},
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemLanguage, val: "java"},
+			{typ: itemCommandBlock, val: "void main whatever\n"},
+			tEOF}},
+	{"blockWithInfoString", "Hello <!-- @1 -->\n" +
+		"``` bash {.numberLines}\necho hey\n```",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemLanguage, val: "bash"},
+			{typ: itemCommandBlock, val: "echo hey\n"},
+			tEOF}},
+	{"attributes", "<!-- @1 @timeout=5m @dir=$HOME/x-->\n" +
+		"```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemBlockAttribute, val: "timeout=5m"},
+			{typ: itemBlockAttribute, val: "dir=$HOME/x"},
+			{typ: itemCommandBlock, val: block2},
+			tEOF}},
+	{"readinessPattern", "<!-- @1 @waitFor=stdout:/Listening on :80/ @2 -->\n" +
+		"```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemBlockAttribute, val: "waitFor=stdout:/Listening on :80/"},
+			{typ: itemBlockLabel, val: "2"},
+			{typ: itemCommandBlock, val: block2},
+			tEOF}},
+	{"quotedAttribute", "<!-- @1 @dir=\"my dir\" @dir=\"\"-->\n" +
+		"```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemBlockAttribute, val: "dir=\"my dir\""},
+			{typ: itemBlockAttribute, val: "dir=\"\""},
+			{typ: itemCommandBlock, val: block2},
+			tEOF}},
+	{"unclosedQuote", "<!-- @1 @dir=\"my dir -->\n" +
+		"```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemError, val: "unclosed quote in block attribute value"},
+			tEOF}},
+	{"tildeFence", "<!-- @1 -->\n" +
+		"~~~ sh\n" + block1 + "```\n~~~~\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemLanguage, val: "sh"},
+			{typ: itemCommandBlock, val: block1 + "```\n"},
+			tEOF}},
+	{"tildeFenceMidLine", "<!-- @1 -->\n" +
+		"~~~\necho ~~~\n ~~~\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCommandBlock, val: "echo ~~~\n"},
+			tEOF}},
+	{"legacyFenceMidLine", "<!-- @1 -->\n" +
+		"```\necho hey```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCommandBlock, val: "echo hey"},
+			tEOF}},
+	{"overIndentedClosingFence", "<!-- @1 -->\n" +
+		"~~~\ncat <<EOF\n    ~~~\nEOF\n~~~\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCommandBlock, val: "cat <<EOF\n    ~~~\nEOF\n"},
+			tEOF}},
+	{"longFence", "<!-- @1 -->\n" +
+		"````\n" +
+		"cat <<EOF >README.md\n```\nls\n```\nEOF\n" +
+		"````\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCommandBlock, val: "cat <<EOF >README.md\n```\nls\n```\nEOF\n"},
+			tEOF}},
+	{"indentedInList", "1. First do this:\n" +
+		"\n" +
+		"   <!-- @1 -->\n" +
+		"   ```\n" +
+		"   echo $PATH\n" +
+		"     echo $GOPATH\n" +
+		"   ```\n" +
+		"2. Then that.\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemCommandBlock, val: "echo $PATH\n  echo $GOPATH\n"},
+			tEOF}},
+	{"unclosedComment", "aa\n <!-- hey", []item{
+		{typ: itemError, val: "unclosed comment"},
+		tEOF}},
+	{"unclosedBlock", "<!-- @1 -->\n```\n" + block2, []item{
+		{typ: itemBlockLabel, val: "1"},
+		{typ: itemError, val: "unclosed command block"},
+		tEOF}},
+	{"recoverFromBadLabel", "<!-- @1 x -->\n" +
+		"```\n" + block1 + "```\n" +
+		"<!-- @2 -->\n" +
+		"```\n" + block2 + "```\n",
+		[]item{
+			{typ: itemBlockLabel, val: "1"},
+			{typ: itemError, val: "improperly closed block label sequence"},
+			{typ: itemBlockLabel, val: "2"},
+			{typ: itemCommandBlock, val: block2},
 			tEOF}},
 }
 
@@ -58,7 +161,7 @@ func collect(t *lexTest) (items []item) {
 	for {
 		item := l.nextItem()
 		items = append(items, item)
-		if item.typ == itemEOF || item.typ == itemError {
+		if item.typ == itemEOF {
 			break
 		}
 	}
@@ -94,3 +197,214 @@ func TestLex(t *testing.T) {
 		}
 	}
 }
+
+func TestParseErrors(t *testing.T) {
+	input := "Hello\n" +
+		"<!-- @1 x -->\n" +
+		"```\n" + block1 + "```\n" +
+		"<!-- @2\n" +
+		"```\n" + block1 + "```\n" +
+		"<!-- @3 -->\n" +
+		"```\n" + block2 + "```\n"
+	m, err := Parse("foo.md", input)
+	if err == nil {
+		t.Fatalf("expected an error")
+	}
+	want := "foo.md:2:9: improperly closed block label sequence\n" +
+		"foo.md:6:8: unclosed block label sequence"
+	if err.Error() != want {
+		t.Errorf("got\n\t%v\nwant\n\t%v", err, want)
+	}
+	if len(m["1"]) != 0 || len(m["2"]) != 0 {
+		t.Errorf("blocks with malformed labels should be dropped")
+	}
+	if blocks := m["3"]; len(blocks) != 1 || blocks[0].Code().String() != block2 {
+		t.Errorf("expected block after errors to be recovered, got %v", m)
+	}
+}
+
+func TestParseLineRange(t *testing.T) {
+	input := "Hello\n" +
+		"<!-- @1 -->\n" +
+		"```\n" + block1 + "```\n" +
+		"\n" +
+		"<!-- @2 -->\n" +
+		"```\n" + block2 + "```\n"
+	m, err := Parse("foo.md", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := m["1"][0].Location(), "foo.md:4-5"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := m["2"][0].Location(), "foo.md:9"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseIndentedLineRange(t *testing.T) {
+	input := "Steps:\n" +
+		"\n" +
+		"1. Build it.\n" +
+		"\n" +
+		"    <!-- @1 -->\n" +
+		"    ```\n" +
+		"    make\n" +
+		"    make test\n" +
+		"    make install\n" +
+		"    ```\n" +
+		"\n" +
+		"    <!-- @2 -->\n" +
+		"    ```\n" +
+		"    make clean\n" +
+		"    ```\n"
+	m, err := Parse("foo.md", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if got, want := m["1"][0].Location(), "foo.md:7-9"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+	if got, want := m["2"][0].Location(), "foo.md:14"; got != want {
+		t.Errorf("got %v, want %v", got, want)
+	}
+}
+
+func TestParseAttributes(t *testing.T) {
+	input := "<!-- @1 @sleep=5s @retry=3 -->\n" +
+		"```\n" + block1 + "```\n" +
+		"<!-- @2 @timeout=soon -->\n" +
+		"```\n" + block2 + "```\n"
+	m, err := Parse("foo.md", input)
+	want := "foo.md:5:10: @timeout needs a duration like 30s, got \"soon\""
+	if err == nil || err.Error() != want {
+		t.Errorf("got\n\t%v\nwant\n\t%v", err, want)
+	}
+	b := m["1"][0]
+	if b.Retries() != 3 {
+		t.Errorf("got %d retries, want 3", b.Retries())
+	}
+	if len(b.Labels()) != 2 {
+		t.Errorf("attributes should not be labels, got %v", b.Labels())
+	}
+	if got, want := b.Code().String(), block1+"\nsleep 5 # Added by mdrip\n"; got != want {
+		t.Errorf("got %q, want %q", got, want)
+	}
+}
+
+func TestParseQuotedAttributes(t *testing.T) {
+	input := "<!-- @1 @dir=\"my dir\" @waitFor=\"file:ready now\" -->\n" +
+		"```\n" + block1 + "```\n" +
+		"<!-- @2 @dir=\"\" -->\n" +
+		"```\n" + block2 + "```\n"
+	m, err := Parse("foo.md", input)
+	want := "foo.md:5:10: @dir needs a path like /tmp, got nothing"
+	if err == nil || err.Error() != want {
+		t.Errorf("got\n\t%v\nwant\n\t%v", err, want)
+	}
+	b := m["1"][0]
+	if b.Dir() != "my dir" {
+		t.Errorf("got dir %q, want %q", b.Dir(), "my dir")
+	}
+	if r := b.WaitFor(); r == nil || r.Target != "ready now" {
+		t.Errorf("got readiness %v, want file:ready now", r)
+	}
+}
+
+func TestParseExpect(t *testing.T) {
+	input := "<!-- @1 -->\n" +
+		"```\necho hello\n```\n" +
+		"which prints\n" +
+		"<!-- @1 @expect -->\n" +
+		"```\nhello\n```\n" +
+		"<!-- @expect -->\n" +
+		"```\nstray\n```\n"
+	m, err := Parse("foo.md", input)
+	if err == nil || !strings.Contains(err.Error(), "foo.md:12:1: @expect block doesn't follow") {
+		t.Errorf("expected an error for the stray @expect block, got %v", err)
+	}
+	if len(m["1"]) != 1 || len(m[model.AnyLabel]) != 1 {
+		t.Fatalf("expected one command block, got %v", m)
+	}
+	e := m["1"][0].Expectation()
+	if e == nil || e.Text() != "hello\n" || e.Location() != "foo.md:8" {
+		t.Errorf("bad expectation %+v", e)
+	}
+}
+
+func TestParseEmptyExpect(t *testing.T) {
+	input := "<!-- @a -->\n" +
+		"```\ntrue\n```\n" +
+		"<!-- @expect -->\n" +
+		"```\n```\n" +
+		"<!-- @b -->\n" +
+		"```\necho hi\n```\n" +
+		"<!-- @c -->\n" +
+		"```\n```\n" +
+		"<!-- @d -->\n" +
+		"```\necho bye\n```\n"
+	m, err := Parse("foo.md", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	if len(m["a"]) != 1 || len(m["b"]) != 1 || len(m["d"]) != 1 || len(m[model.AnyLabel]) != 3 {
+		t.Fatalf("expected blocks a, b and d, got %v", m)
+	}
+	e := m["a"][0].Expectation()
+	if e == nil || e.Text() != "" || e.FirstLine() != 7 || e.LastLine() != 6 {
+		t.Errorf("expected an empty expectation before line 7, got %+v", e)
+	}
+	if m["b"][0].Expectation() != nil || len(m["b"][0].Labels()) != 2 {
+		t.Errorf("@expect carried over to block b: %v", m["b"][0].Labels())
+	}
+	if len(m["c"]) != 0 || len(m["d"][0].Labels()) != 2 {
+		t.Errorf("labels of an empty block carried over: %v", m["d"][0].Labels())
+	}
+}
+
+func TestParseTranscript(t *testing.T) {
+	input := "<!-- @demo -->\n" +
+		"```console\n" +
+		"Try this:\n" +
+		"$ echo hello \\\n" +
+		"    world\n" +
+		"hello world\n" +
+		"# cat <<EOF\n" +
+		"> one\n" +
+		"> EOF\n" +
+		"one\n" +
+		"$ true\n" +
+		"```\n"
+	m, err := Parse("foo.md", input)
+	if err != nil {
+		t.Fatalf("unexpected error: %v", err)
+	}
+	blocks := m["demo"]
+	if len(blocks) != 3 {
+		t.Fatalf("expected a block per command, got %d", len(blocks))
+	}
+	tests := []struct {
+		code, location, expected, expectedLocation string
+	}{
+		{"echo hello \\\n    world\n", "foo.md:4-5", "hello world\n", "foo.md:6"},
+		{"cat <<EOF\none\nEOF\n", "foo.md:7-9", "one\n", "foo.md:10"},
+		{"true\n", "foo.md:11", "", "foo.md:12"},
+	}
+	for i, test := range tests {
+		b := blocks[i]
+		if b.Code().String() != test.code || b.Location() != test.location ||
+			b.Language() != "console" {
+			t.Errorf("block %d: got %q at %s", i, b.Code(), b.Location())
+		}
+		e := b.Expectation()
+		if e == nil || e.Text() != test.expected || e.Location() != test.expectedLocation {
+			t.Errorf("block %d: bad expectation %+v", i, e)
+		}
+	}
+
+	prompt, _ := NewPrompt(`PS> `)
+	m, _ = ParseWithPrompt("foo.md", "<!-- @x -->\n```console\nPS> dir\nfoo\n$ nope\n```\n", prompt)
+	if len(m[model.AnyLabel]) != 1 || m[model.AnyLabel][0].Expectation().Text() != "foo\n$ nope\n" {
+		t.Errorf("custom prompt not honored: %v", m[model.AnyLabel])
+	}
+}
@@ -0,0 +1,74 @@
+package lexer
+
+import (
+	"regexp"
+	"strings"
+)
+
+// DefaultPrompt matches the prompts of a user ("$ ") and of root
+// ("# ") at the start of a line of a terminal session.
+const DefaultPrompt = `[$#] `
+
+// continuationPrompt starts the continuation lines of a command,
+// as in bash's default PS2.
+const continuationPrompt = "> "
+
+// transcriptLanguages name the fence languages of blocks holding a
+// terminal session, i.e. commands after prompts, each followed by
+// its output.
+var transcriptLanguages = map[string]bool{
+	"console":       true,
+	"shell-session": true,
+	"sh-session":    true,
+}
+
+// NewPrompt compiles a prompt pattern, anchoring it to the start of
+// a line.
+func NewPrompt(pattern string) (*regexp.Regexp, error) {
+	return regexp.Compile(`^(?:` + pattern + `)`)
+}
+
+// transcriptCommand is a command taken from a terminal session, with
+// the output following it.  Lines are counted from zero at the start
+// of the session.
+type transcriptCommand struct {
+	code        string
+	first, last int // Lines holding the command.
+	output      string
+	outputFirst int // First line of output, or the line after the command if none.
+	outputLast  int // Last line of output, or outputFirst-1 if none.
+}
+
+// splitTranscript splits a terminal session into commands, stripped
+// of prompts, each with the output following it.  A command continues
+// onto the next line if it ends with a backslash, or if the next line
+// starts with a continuation prompt.  Lines before the first prompt
+// are ignored.
+func splitTranscript(session string, prompt *regexp.Regexp) []*transcriptCommand {
+	var result []*transcriptCommand
+	var current *transcriptCommand
+	continued := false
+	lines := strings.SplitAfter(session, "\n")
+	if len(lines) > 0 && lines[len(lines)-1] == "" {
+		lines = lines[:len(lines)-1]
+	}
+	for i, line := range lines {
+		switch {
+		case current != nil && current.output == "" &&
+			(continued || strings.HasPrefix(line, continuationPrompt)):
+			current.code += strings.TrimPrefix(line, continuationPrompt)
+			current.last = i
+			current.outputFirst, current.outputLast = i+1, i
+		case prompt.MatchString(line):
+			loc := prompt.FindStringIndex(line)
+			current = &transcriptCommand{
+				code: line[loc[1]:], first: i, last: i, outputFirst: i + 1, outputLast: i}
+			result = append(result, current)
+		case current != nil:
+			current.output += line
+			current.outputLast = i
+		}
+		continued = strings.HasSuffix(strings.TrimRight(line, "\n"), `\`)
+	}
+	return result
+}
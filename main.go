@@ -1,18 +1,22 @@
 package main
 
 import (
+	"fmt"
 	"log"
 	"os"
 
 	"github.com/monopole/mdrip/config"
+	"github.com/monopole/mdrip/model"
 	"github.com/monopole/mdrip/program"
+	"github.com/monopole/mdrip/report"
 	"github.com/monopole/mdrip/tmux"
 )
 
 func main() {
 	c := config.GetConfig()
 	// A program has a timeout and a name.
-	p := program.NewProgram(c.BlockTimeOut(), c.ScriptName(), c.FileNames())
+	p := program.NewProgram(c.BlockTimeOut(), c.ScriptName(), c.FileNames()).
+		SetLanguages(c.Languages()).SetInterpreters(c.Interpreters()).SetPrompt(c.Prompt())
 
 	switch c.Mode() {
 	case config.ModeTmux:
@@ -22,16 +26,80 @@ func main() {
 			log.Fatal(err)
 		}
 		p.Serve(t, c.HostAndPort())
+	case config.ModeStep:
+		if err := p.Reload(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if p.ScriptCount() < 1 {
+				os.Exit(1)
+			}
+		}
+		in, err := p.StepInput()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if err := p.Step(in, os.Stdout); err != nil {
+			log.Fatal(err)
+		}
 	case config.ModeTest:
-		p.Reload()
-		if r := p.RunInSubShell(); r.Problem() != nil {
-			r.Print(c.ScriptName())
+		if err := p.Reload(); err != nil {
+			// Unreadable or unparsable markdown means some blocks would
+			// go untested.
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(1)
+		}
+		if c.JSONEvents() {
+			p.SetEventStream(os.Stdout)
+		}
+		r := p.SetKeepGoing(c.KeepGoing()).SetUpdate(c.Update()).
+			SetMaxOutput(c.MaxOutput()).RunInSubShell()
+		writeReports(c.Reports(), p.Results())
+		if c.Update() {
+			updated, err := p.UpdateExpectations()
+			if err != nil {
+				fmt.Fprintln(os.Stderr, err)
+				os.Exit(1)
+			}
+			for _, fileName := range updated {
+				fmt.Fprintf(os.Stderr, "Updated %s\n", fileName)
+			}
+		}
+		if reaped := p.Reaped(); len(reaped) > 0 {
+			fmt.Fprintln(os.Stderr, "Killed processes left running by blocks:")
+			for _, proc := range reaped {
+				fmt.Fprintln(os.Stderr, "  "+proc.String())
+			}
+		}
+		if c.KeepGoing() {
+			for _, f := range p.Results() {
+				if f.Problem() != nil {
+					f.Print(c.ScriptName())
+				}
+			}
+			report.Summary(os.Stderr, p.Results())
+		}
+		if r.Problem() != nil {
+			if !c.KeepGoing() {
+				r.Print(c.ScriptName())
+				// Cleanup blocks run however the run ends, so may fail
+				// apart from r.
+				for _, f := range p.Results() {
+					if f != r && f.Problem() != nil && f.Block().Cleanup() {
+						f.Print(c.ScriptName())
+					}
+				}
+			}
 			if !c.IgnoreTestFailure() {
 				log.Fatal(r.Problem())
 			}
 		}
 	default:
-		p.Reload()
+		if err := p.Reload(); err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			if p.ScriptCount() < 1 {
+				os.Exit(1)
+			}
+		}
 		if c.Preambled() > 0 {
 			p.PrintPreambled(os.Stdout, c.Preambled())
 		} else {
@@ -39,3 +107,28 @@ func main() {
 		}
 	}
 }
+
+// writeReports writes each report, complaining about (but otherwise
+// ignoring) reports that cannot be written.
+func writeReports(reports []config.Report, results []*model.RunResult) {
+	for _, r := range reports {
+		if err := writeReport(r, results); err != nil {
+			fmt.Fprintf(os.Stderr, "Unable to write %s report: %v\n", r.Format, err)
+		}
+	}
+}
+
+func writeReport(r config.Report, results []*model.RunResult) error {
+	if r.Path == "" {
+		return report.Writers[r.Format](os.Stdout, results)
+	}
+	f, err := os.Create(r.Path)
+	if err != nil {
+		return err
+	}
+	if err := report.Writers[r.Format](f, results); err != nil {
+		f.Close()
+		return err
+	}
+	return f.Close()
+}
@@ -0,0 +1,55 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"time"
+)
+
+// Attribute names, i.e. the keys in "@key=value" annotations.
+//
+// Unlike labels, attributes don't select blocks; they change how a
+// block runs.
+const (
+	AttrTimeout     = "timeout"     // Max time to wait for the block to finish.
+	AttrSleep       = "sleep"       // Time to sleep after the block finishes.
+	AttrRetry       = "retry"       // Number of times to retry a failing block.
+	AttrDir         = "dir"         // Directory in which to run the block.
+	AttrShell       = "shell"       // Name of the shell in which to run the block.
+	AttrWaitFor     = "waitFor"     // Condition to wait for after the block finishes.
+	AttrWaitTimeout = "waitTimeout" // Max time to wait for the condition.
+)
+
+// shellName matches the names that may be given to shells.
+var shellName = regexp.MustCompile(`^[A-Za-z0-9_-]+$`)
+
+// ValidateAttribute returns an error if the attribute is unknown, or
+// if its value is malformed.
+func ValidateAttribute(key, value string) error {
+	switch key {
+	case AttrTimeout, AttrSleep, AttrWaitTimeout:
+		if d, err := time.ParseDuration(value); err != nil || d < 0 {
+			return fmt.Errorf("@%s needs a duration like 30s, got %q", key, value)
+		}
+	case AttrRetry:
+		if n, err := strconv.Atoi(value); err != nil || n < 0 {
+			return fmt.Errorf("@%s needs a count like 3, got %q", key, value)
+		}
+	case AttrDir:
+		if value == "" {
+			return fmt.Errorf("@%s needs a path like /tmp, got nothing", key)
+		}
+	case AttrShell:
+		if !shellName.MatchString(value) {
+			return fmt.Errorf("@%s needs a name like server, got %q", key, value)
+		}
+	case AttrWaitFor:
+		if _, err := ParseReadiness(value); err != nil {
+			return err
+		}
+	default:
+		return fmt.Errorf("unknown block attribute @%s", key)
+	}
+	return nil
+}
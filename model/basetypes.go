@@ -8,6 +8,15 @@ type Label string
 
 const (
 	AnyLabel = Label(`__AnyLabel__`)
+	// IndependentLabel marks a block that needs no state from the
+	// blocks before it, so may run in a shell of its own.
+	IndependentLabel = Label("independent")
+	// ExpectLabel marks a block holding the output expected of the
+	// command block before it, rather than commands.
+	ExpectLabel = Label("expect")
+	// CleanupLabel marks a block that undoes what other blocks did,
+	// e.g. stopping a server, so must run however the run ends.
+	CleanupLabel = Label("cleanup")
 )
 
 func (l Label) String() string {
@@ -3,6 +3,9 @@ package model
 import (
 	"fmt"
 	"io"
+	"strconv"
+	"strings"
+	"time"
 )
 
 // opaqueCode is an opaque, uninterpreted, unknown block of text that
@@ -18,10 +21,17 @@ func (c opaqueCode) Bytes() []byte {
 	return []byte(c)
 }
 
-// CommandBlock groups opaqueCode with its labels.
+// CommandBlock groups opaqueCode with its labels and attributes, and
+// where it came from.
 type CommandBlock struct {
-	labels []Label
-	code   opaqueCode
+	labels     []Label
+	attributes map[string]string // Keyed by attribute name, e.g. AttrTimeout.
+	code       opaqueCode
+	language   string       // Language named in the fence info string, if any.
+	fileName   FileName     // File holding the block, if known.
+	firstLine  int          // Markdown line holding the first line of code.
+	lastLine   int          // Markdown line holding the last line of code.
+	expect     *Expectation // Expected stdout, if any.
 }
 
 const (
@@ -33,6 +43,8 @@ const (
      {{ .Name }}
   </span>
   <span class="spacer"> &nbsp; </span>
+  <span class="location">{{ .Location }}</span>
+  {{ if .Language }}<span class="location">{{ .Language }}</span>{{ end }}
 </h3>
 <pre class="codeblock">
 {{ .Code }}
@@ -46,7 +58,42 @@ func NewCommandBlock(labels []Label, code string) *CommandBlock {
 		// Assure at least one label.
 		labels = []Label{Label("unknown")}
 	}
-	return &CommandBlock{labels, opaqueCode(code)}
+	return &CommandBlock{labels, map[string]string{}, opaqueCode(code), "", "", 0, 0, nil}
+}
+
+// SetAttribute records an "@key=value" annotation.
+func (x *CommandBlock) SetAttribute(key, value string) *CommandBlock {
+	x.attributes[key] = value
+	return x
+}
+
+// SetLanguage records the language named after the block's opening
+// code fence, e.g. "bash" or "yaml".
+func (x *CommandBlock) SetLanguage(language string) *CommandBlock {
+	x.language = language
+	return x
+}
+
+// SetSource records the file and the range of lines (1-based,
+// inclusive) in that file holding the block's code.
+func (x *CommandBlock) SetSource(fileName FileName, first, last int) *CommandBlock {
+	x.fileName = fileName
+	x.firstLine = first
+	x.lastLine = last
+	return x
+}
+
+// SetExpectation records the output the block should print, from an
+// @expect block following it.
+func (x *CommandBlock) SetExpectation(e *Expectation) *CommandBlock {
+	x.expect = e
+	return x
+}
+
+// Expectation returns the output the block should print, or nil if
+// any output will do.
+func (x CommandBlock) Expectation() *Expectation {
+	return x.expect
 }
 
 // GetName returns the name of the command block.
@@ -65,9 +112,139 @@ func (x CommandBlock) Code() opaqueCode {
 	return x.code
 }
 
+// Attributes returns the block's "@key=value" annotations.
+func (x CommandBlock) Attributes() map[string]string {
+	return x.attributes
+}
+
+// Timeout returns the time allowed for the block to finish, or zero
+// if the block doesn't specify one.
+func (x CommandBlock) Timeout() time.Duration {
+	d, _ := time.ParseDuration(x.attributes[AttrTimeout])
+	return d
+}
+
+// Sleep returns the time to pause after the block finishes, or zero.
+func (x CommandBlock) Sleep() time.Duration {
+	d, _ := time.ParseDuration(x.attributes[AttrSleep])
+	return d
+}
+
+// Retries returns the number of times to retry the block if it
+// fails, or zero.
+func (x CommandBlock) Retries() int {
+	n, _ := strconv.Atoi(x.attributes[AttrRetry])
+	return n
+}
+
+// Dir returns the directory in which to run the block, or the empty
+// string to run it wherever the previous block left off.
+func (x CommandBlock) Dir() string {
+	return x.attributes[AttrDir]
+}
+
+// Shell returns the name of the shell in which to run the block, or
+// the empty string for the default shell.
+func (x CommandBlock) Shell() string {
+	return x.attributes[AttrShell]
+}
+
+// WaitFor returns the condition to wait for after the block finishes,
+// or nil if there's nothing to wait for.
+func (x CommandBlock) WaitFor() *Readiness {
+	r, err := ParseReadiness(x.attributes[AttrWaitFor])
+	if err != nil {
+		return nil
+	}
+	return r
+}
+
+// WaitTimeout returns how long to wait for the block's WaitFor
+// condition.
+func (x CommandBlock) WaitTimeout() time.Duration {
+	if d, err := time.ParseDuration(x.attributes[AttrWaitTimeout]); err == nil {
+		return d
+	}
+	return DefaultWaitTimeout
+}
+
+// Independent is true if the block is labeled as needing no state
+// from the blocks before it.
+func (x CommandBlock) Independent() bool {
+	for _, l := range x.labels {
+		if l == IndependentLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// Cleanup is true if the block is labeled as cleaning up after the
+// other blocks, so runs after them, however they fare.
+func (x CommandBlock) Cleanup() bool {
+	for _, l := range x.labels {
+		if l == CleanupLabel {
+			return true
+		}
+	}
+	return false
+}
+
+// Language returns the language named in the block's fence info
+// string, or the empty string if none was named.
+func (x CommandBlock) Language() string {
+	return x.language
+}
+
+// HasLanguage is true if the block's language is one of the given
+// languages (ignoring case), or if the block names no language.
+func (x CommandBlock) HasLanguage(languages []string) bool {
+	if x.language == "" {
+		return true
+	}
+	for _, l := range languages {
+		if strings.EqualFold(l, x.language) {
+			return true
+		}
+	}
+	return false
+}
+
+func (x CommandBlock) FileName() FileName {
+	return x.fileName
+}
+
+// FirstLine returns the markdown line number of the first line of
+// code, or zero if unknown.
+func (x CommandBlock) FirstLine() int {
+	return x.firstLine
+}
+
+// LastLine returns the markdown line number of the last line of
+// code, or zero if unknown.
+func (x CommandBlock) LastLine() int {
+	return x.lastLine
+}
+
+// Location returns a string like "file.md:42-57", in the form
+// understood by editors and CI annotations.
+func (x CommandBlock) Location() string {
+	return string(x.fileName) + x.lineRange()
+}
+
+func (x CommandBlock) lineRange() string {
+	switch {
+	case x.firstLine < 1:
+		return ""
+	case x.lastLine <= x.firstLine:
+		return fmt.Sprintf(":%d", x.firstLine)
+	}
+	return fmt.Sprintf(":%d-%d", x.firstLine, x.lastLine)
+}
+
 func (x CommandBlock) Print(
 	w io.Writer, prefix string, n int, label Label, fileName FileName) {
-	fmt.Fprintf(w, "echo \"%s @%s (block #%d in %s) of %s\"\n\n",
-		prefix, x.Name(), n, label, fileName)
+	fmt.Fprintf(w, "echo \"%s @%s (block #%d in %s) of %s%s\"\n\n",
+		prefix, x.Name(), n, label, fileName, x.lineRange())
 	fmt.Fprint(w, x.Code())
 }
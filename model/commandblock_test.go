@@ -0,0 +1,30 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestHasLanguage(t *testing.T) {
+	bashAndSh := []string{"bash", "sh"}
+	for _, c := range []struct {
+		language  string
+		languages []string
+		want      bool
+	}{
+		{"bash", bashAndSh, true},
+		{"sh", bashAndSh, true},
+		{"BASH", bashAndSh, true},
+		{"", bashAndSh, true},
+		{"yaml", bashAndSh, false},
+		{"json", bashAndSh, false},
+		{"yaml", []string{}, false},
+		{"", []string{}, true},
+	} {
+		b := NewCommandBlock([]Label{"x"}, "code\n").SetLanguage(c.language)
+		if got := b.HasLanguage(c.languages); got != c.want {
+			t.Errorf("%q in [%s]: got %v, want %v",
+				c.language, strings.Join(c.languages, ","), got, c.want)
+		}
+	}
+}
@@ -0,0 +1,309 @@
+package model
+
+import (
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// Expectation is the output a command block is expected to print on
+// stdout, held by an @expect block following the command block.
+//
+// Lines match exactly, ignoring trailing whitespace, except that a
+// line holding only "..." matches any number of lines, "..." within
+// a line matches any text, and a line ending in " (re)" is a regular
+// expression that must match the whole line.
+type Expectation struct {
+	text      string
+	fileName  FileName // File holding the @expect block, if known.
+	firstLine int      // Markdown line holding the first line of text.
+	lastLine  int      // Markdown line holding the last; firstLine-1 if none.
+	indent    string   // Indentation removed from each line of text.
+}
+
+const (
+	ellipsis    = "..."
+	regexSuffix = " (re)"
+)
+
+func NewExpectation(text string) *Expectation {
+	return &Expectation{text, "", 0, -1, ""}
+}
+
+// SetSource records the file and the range of lines (1-based,
+// inclusive) in that file holding the expected text.
+func (x *Expectation) SetSource(fileName FileName, first, last int) *Expectation {
+	x.fileName = fileName
+	x.firstLine = first
+	x.lastLine = last
+	return x
+}
+
+// SetIndent records the indentation of the @expect block in the
+// markdown, e.g. when it's in a list.
+func (x *Expectation) SetIndent(indent string) *Expectation {
+	x.indent = indent
+	return x
+}
+
+func (x *Expectation) Indent() string {
+	return x.indent
+}
+
+func (x *Expectation) Text() string {
+	return x.text
+}
+
+func (x *Expectation) FileName() FileName {
+	return x.fileName
+}
+
+func (x *Expectation) FirstLine() int {
+	return x.firstLine
+}
+
+func (x *Expectation) LastLine() int {
+	return x.lastLine
+}
+
+// Location returns where the expected text came from, e.g.
+// "docs/setup.md:60-62".
+func (x *Expectation) Location() string {
+	if x.lastLine <= x.firstLine {
+		return fmt.Sprintf("%s:%d", x.fileName, x.firstLine)
+	}
+	return fmt.Sprintf("%s:%d-%d", x.fileName, x.firstLine, x.lastLine)
+}
+
+// splitLines splits text into lines without trailing whitespace.
+func splitLines(text string) []string {
+	text = strings.TrimRight(text, "\n")
+	if text == "" {
+		return nil
+	}
+	lines := strings.Split(text, "\n")
+	for i, line := range lines {
+		lines[i] = strings.TrimRight(line, " \t\r")
+	}
+	return lines
+}
+
+// lineMatcher returns a function telling whether an output line
+// matches the expected line, which may be a pattern.  Any pattern is
+// compiled here, once, rather than for every line it's tried on.
+func lineMatcher(expected string) func(string) bool {
+	if strings.HasSuffix(expected, regexSuffix) {
+		re, err := regexp.Compile(`^(?:` + strings.TrimSuffix(expected, regexSuffix) + `)$`)
+		if err != nil {
+			return func(string) bool { return false }
+		}
+		return re.MatchString
+	}
+	if !strings.Contains(expected, ellipsis) {
+		return func(line string) bool { return expected == line }
+	}
+	parts := strings.Split(expected, ellipsis)
+	for i, part := range parts {
+		parts[i] = regexp.QuoteMeta(part)
+	}
+	return regexp.MustCompile(`^` + strings.Join(parts, `.*`) + `$`).MatchString
+}
+
+// lineMatchers returns a lineMatcher for each of the expected lines.
+func lineMatchers(expected []string) []func(string) bool {
+	result := make([]func(string) bool, len(expected))
+	for i, line := range expected {
+		if line != ellipsis {
+			result[i] = lineMatcher(line)
+		}
+	}
+	return result
+}
+
+// align returns a table whose [i][j] entry is the fewest lines that
+// must be added or removed for expected[i:] to match actual[j:],
+// given the expected lines' lineMatchers.
+func align(expected, actual []string, matches []func(string) bool) [][]int {
+	cost := make([][]int, len(expected)+1)
+	for i := range cost {
+		cost[i] = make([]int, len(actual)+1)
+	}
+	for j := len(actual) - 1; j >= 0; j-- {
+		cost[len(expected)][j] = cost[len(expected)][j+1] + 1
+	}
+	for i := len(expected) - 1; i >= 0; i-- {
+		if expected[i] == ellipsis {
+			cost[i][len(actual)] = cost[i+1][len(actual)]
+		} else {
+			cost[i][len(actual)] = cost[i+1][len(actual)] + 1
+		}
+		for j := len(actual) - 1; j >= 0; j-- {
+			if expected[i] == ellipsis {
+				cost[i][j] = minInt(cost[i+1][j], cost[i][j+1])
+				continue
+			}
+			cost[i][j] = minInt(cost[i+1][j], cost[i][j+1]) + 1
+			if matches[i](actual[j]) && cost[i+1][j+1] < cost[i][j] {
+				cost[i][j] = cost[i+1][j+1]
+			}
+		}
+	}
+	return cost
+}
+
+// Matches is true if output is as expected.
+func (x *Expectation) Matches(output string) bool {
+	expected := splitLines(x.text)
+	return align(expected, splitLines(output), lineMatchers(expected))[0][0] == 0
+}
+
+// Steps in an alignment of expected lines with actual lines.
+const (
+	stepMatch  = iota // The expected line matches the actual line.
+	stepSkip          // An ellipsis swallows the actual line.
+	stepEnd           // An ellipsis ends.
+	stepRemove        // The expected line is missing.
+	stepAdd           // The actual line is unexpected.
+)
+
+// walk visits the steps of the cheapest alignment of expected lines
+// with actual lines (see align), with the indices of the lines
+// concerned.
+func walk(expected, actual []string, matches []func(string) bool, cost [][]int,
+	visit func(step byte, i, j int)) {
+	i, j := 0, 0
+	for i < len(expected) || j < len(actual) {
+		switch {
+		case i < len(expected) && expected[i] == ellipsis:
+			// End the ellipsis as soon as possible, so that lines it
+			// might swallow can match the lines that follow it.
+			if j < len(actual) && cost[i][j] != cost[i+1][j] {
+				visit(stepSkip, i, j)
+				j++
+			} else {
+				visit(stepEnd, i, j)
+				i++
+			}
+		case i < len(expected) && j < len(actual) &&
+			matches[i](actual[j]) && cost[i][j] == cost[i+1][j+1]:
+			visit(stepMatch, i, j)
+			i, j = i+1, j+1
+		case i < len(expected) && cost[i][j] == cost[i+1][j]+1:
+			visit(stepRemove, i, j)
+			i++
+		default:
+			visit(stepAdd, i, j)
+			j++
+		}
+	}
+}
+
+// Update returns the expected text revised to match output, keeping
+// expected lines, including patterns, that match it.
+func (x *Expectation) Update(output string) string {
+	expected, actual := splitLines(x.text), splitLines(output)
+	matches := lineMatchers(expected)
+	var b strings.Builder
+	walk(expected, actual, matches, align(expected, actual, matches), func(step byte, i, j int) {
+		switch step {
+		case stepMatch, stepEnd:
+			b.WriteString(expected[i] + "\n")
+		case stepAdd:
+			b.WriteString(actual[j] + "\n")
+		}
+	})
+	return b.String()
+}
+
+// diffLine is a line of a diff, along with the indices of the
+// expected and actual lines preceding it.
+type diffLine struct {
+	kind byte // ' ', '-' or '+'.
+	text string
+	i, j int
+}
+
+// Diff returns a unified diff from the expected text to the given
+// output, or the empty string if they match.  Output lines matched by
+// patterns appear as context.
+func (x *Expectation) Diff(output string) string {
+	expected, actual := splitLines(x.text), splitLines(output)
+	matches := lineMatchers(expected)
+	cost := align(expected, actual, matches)
+	if cost[0][0] == 0 {
+		return ""
+	}
+	var lines []diffLine
+	walk(expected, actual, matches, cost, func(step byte, i, j int) {
+		switch step {
+		case stepMatch, stepSkip:
+			lines = append(lines, diffLine{' ', actual[j], i, j})
+		case stepRemove:
+			lines = append(lines, diffLine{'-', expected[i], i, j})
+		case stepAdd:
+			lines = append(lines, diffLine{'+', actual[j], i, j})
+		}
+	})
+	var b strings.Builder
+	fmt.Fprintf(&b, "--- expected")
+	if x.fileName != "" {
+		fmt.Fprintf(&b, " (%s)", x.Location())
+	}
+	fmt.Fprintf(&b, "\n+++ actual\n")
+	writeHunks(&b, lines, len(expected), len(actual))
+	return b.String()
+}
+
+// MismatchError reports that a block printed something other than
+// its Expectation.
+type MismatchError struct {
+	Expectation *Expectation
+	Output      string
+}
+
+func (e *MismatchError) Error() string {
+	return "output differs from expected output\n" + e.Expectation.Diff(e.Output)
+}
+
+// diffContext is the number of unchanged lines shown around changes.
+const diffContext = 3
+
+// writeHunks writes the changed lines, with context, as hunks in the
+// manner of "diff -u".
+func writeHunks(b *strings.Builder, lines []diffLine, numExpected, numActual int) {
+	for start := 0; start < len(lines); {
+		if lines[start].kind == ' ' {
+			start++
+			continue
+		}
+		// Extend the hunk while changes are close together.
+		end := start
+		for k := start; k < len(lines) && k <= end+2*diffContext; k++ {
+			if lines[k].kind != ' ' {
+				end = k
+			}
+		}
+		first := start - diffContext
+		if first < 0 {
+			first = 0
+		}
+		last := minInt(len(lines), end+diffContext+1)
+		i0, j0 := lines[first].i, lines[first].j
+		i1, j1 := numExpected, numActual
+		if last < len(lines) {
+			i1, j1 = lines[last].i, lines[last].j
+		}
+		fmt.Fprintf(b, "@@ -%d,%d +%d,%d @@\n", i0+1, i1-i0, j0+1, j1-j0)
+		for _, l := range lines[first:last] {
+			b.WriteString(string(l.kind) + l.text + "\n")
+		}
+		start = last
+	}
+}
+
+func minInt(a, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
@@ -0,0 +1,56 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestExpectationMatches(t *testing.T) {
+	tests := []struct {
+		expected, output string
+		want             bool
+	}{
+		{"hello\n", "hello\n", true},
+		{"hello\n", "hello  \n", true},
+		{"hello\n", "goodbye\n", false},
+		{"", "", true},
+		{"", "surprise\n", false},
+		{"one\n...\nfour\n", "one\ntwo\nthree\nfour\n", true},
+		{"one\n...\nfour\n", "one\nfour\n", true},
+		{"one\n...\nfour\n", "one\ntwo\n", false},
+		{"pid ... started\n", "pid 4321 started\n", true},
+		{"pid ... started\n", "pid 4321 stopped\n", false},
+		{"version [0-9.]+ (re)\n", "version 1.2.3\n", true},
+		{"version [0-9.]+ (re)\n", "version 1.2.3-beta\n", false},
+		{"a.c\n", "abc\n", false},
+		{"version [0-9 (re)\n", "version [0-9 (re)\n", false},
+	}
+	for _, test := range tests {
+		e := NewExpectation(test.expected)
+		if got := e.Matches(test.output); got != test.want {
+			t.Errorf("%q vs %q: got %v, want %v", test.expected, test.output, got, test.want)
+		}
+		if diff := e.Diff(test.output); (diff == "") != test.want {
+			t.Errorf("%q vs %q: unexpected diff %q", test.expected, test.output, diff)
+		}
+	}
+}
+
+func TestExpectationDiff(t *testing.T) {
+	e := NewExpectation("a\n...\nd\ne\nf\ng\nh\ni\nj\n").SetSource("foo.md", 10, 18)
+	got := e.Diff("a\nb\nc\nd\nE\nf\ng\nh\ni\nj\n")
+	want := `--- expected (foo.md:10-18)
++++ actual
+@@ -2,6 +2,7 @@
+ b
+ c
+ d
+-e
++E
+ f
+ g
+ h
+`
+	if got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
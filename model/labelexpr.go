@@ -0,0 +1,163 @@
+package model
+
+import (
+	"fmt"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+)
+
+// LabelExpr is a boolean expression over labels, used to select
+// command blocks, e.g. "lesson1 && !slow" or
+// "install || (upgrade && linux)".
+type LabelExpr interface {
+	// Matches is true if the given labels satisfy the expression.
+	Matches(labels []Label) bool
+	String() string
+}
+
+type anyExpr struct{}
+
+func (anyExpr) Matches(labels []Label) bool { return true }
+func (anyExpr) String() string              { return AnyLabel.String() }
+
+type labelExpr Label
+
+func (e labelExpr) Matches(labels []Label) bool {
+	for _, l := range labels {
+		if l == Label(e) {
+			return true
+		}
+	}
+	return false
+}
+func (e labelExpr) String() string { return string(e) }
+
+type notExpr struct{ x LabelExpr }
+
+func (e notExpr) Matches(labels []Label) bool { return !e.x.Matches(labels) }
+func (e notExpr) String() string              { return "!" + e.x.String() }
+
+type andExpr struct{ x, y LabelExpr }
+
+func (e andExpr) Matches(labels []Label) bool { return e.x.Matches(labels) && e.y.Matches(labels) }
+func (e andExpr) String() string              { return "(" + e.x.String() + " && " + e.y.String() + ")" }
+
+type orExpr struct{ x, y LabelExpr }
+
+func (e orExpr) Matches(labels []Label) bool { return e.x.Matches(labels) || e.y.Matches(labels) }
+func (e orExpr) String() string              { return "(" + e.x.String() + " || " + e.y.String() + ")" }
+
+// ParseLabelExpr parses a label expression.  Operands are labels
+// (optionally written with a leading labelMarker), and operators are,
+// in order of increasing precedence, "||", "&&" and "!".  Parentheses
+// group.  AnyLabel matches every block.
+func ParseLabelExpr(l Label) (LabelExpr, error) {
+	if l.IsAny() {
+		return anyExpr{}, nil
+	}
+	p := &exprParser{input: string(l)}
+	e, err := p.parseOr()
+	if err != nil {
+		return nil, err
+	}
+	if tok := p.peek(); tok != "" {
+		return nil, p.errorf("unexpected %q", tok)
+	}
+	return e, nil
+}
+
+// exprParser is a recursive descent parser for label expressions.
+type exprParser struct {
+	input string
+	pos   int
+}
+
+func (p *exprParser) errorf(format string, args ...interface{}) error {
+	return fmt.Errorf("bad label expression %q at offset %d: %s",
+		p.input, p.pos, fmt.Sprintf(format, args...))
+}
+
+func isLabelRune(r rune) bool {
+	return r == '_' || unicode.IsLetter(r) || unicode.IsDigit(r)
+}
+
+func isLabel(tok string) bool {
+	tok = strings.TrimPrefix(tok, "@")
+	return tok != "" && strings.TrimLeftFunc(tok, isLabelRune) == ""
+}
+
+// peek returns the next token without consuming it, or the empty
+// string at the end of input.
+func (p *exprParser) peek() string {
+	rest := strings.TrimLeftFunc(p.input[p.pos:], unicode.IsSpace)
+	switch {
+	case rest == "":
+		return ""
+	case strings.HasPrefix(rest, "&&"), strings.HasPrefix(rest, "||"):
+		return rest[:2]
+	}
+	body := strings.TrimPrefix(rest, "@")
+	if tail := strings.TrimLeftFunc(body, isLabelRune); len(tail) < len(body) {
+		return rest[:len(rest)-len(tail)]
+	}
+	// Not a label; an operator or junk.
+	_, size := utf8.DecodeRuneInString(rest)
+	return rest[:size]
+}
+
+func (p *exprParser) next() string {
+	tok := p.peek()
+	p.pos = len(p.input) - len(strings.TrimLeftFunc(p.input[p.pos:], unicode.IsSpace)) + len(tok)
+	return tok
+}
+
+func (p *exprParser) parseOr() (LabelExpr, error) {
+	x, err := p.parseAnd()
+	for err == nil && p.peek() == "||" {
+		p.next()
+		var y LabelExpr
+		if y, err = p.parseAnd(); err == nil {
+			x = orExpr{x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseAnd() (LabelExpr, error) {
+	x, err := p.parseUnary()
+	for err == nil && p.peek() == "&&" {
+		p.next()
+		var y LabelExpr
+		if y, err = p.parseUnary(); err == nil {
+			x = andExpr{x, y}
+		}
+	}
+	return x, err
+}
+
+func (p *exprParser) parseUnary() (LabelExpr, error) {
+	switch tok := p.next(); {
+	case tok == "":
+		return nil, p.errorf("expected a label")
+	case tok == "!":
+		x, err := p.parseUnary()
+		if err != nil {
+			return nil, err
+		}
+		return notExpr{x}, nil
+	case tok == "(":
+		x, err := p.parseOr()
+		if err != nil {
+			return nil, err
+		}
+		if p.next() != ")" {
+			return nil, p.errorf("expected \")\"")
+		}
+		return x, nil
+	case isLabel(tok):
+		return labelExpr(strings.TrimPrefix(tok, "@")), nil
+	default:
+		return nil, p.errorf("unexpected %q", tok)
+	}
+}
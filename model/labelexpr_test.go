@@ -0,0 +1,49 @@
+package model
+
+import (
+	"testing"
+)
+
+func TestLabelExpr(t *testing.T) {
+	blockLabels := []Label{"lesson1", "install", "linux"}
+	tests := []struct {
+		expr string
+		want bool
+	}{
+		{"lesson1", true},
+		{"@lesson1", true},
+		{"slow", false},
+		{"lesson1 && !slow", true},
+		{"lesson1&&slow", false},
+		{"slow || install", true},
+		{"!(install || upgrade)", false},
+		{"install || (upgrade && linux)", true},
+		{"upgrade || install && !linux", false},
+		{"!!linux", true},
+	}
+	for _, test := range tests {
+		e, err := ParseLabelExpr(Label(test.expr))
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", test.expr, err)
+			continue
+		}
+		if got := e.Matches(blockLabels); got != test.want {
+			t.Errorf("%q (parsed as %s): got %v, want %v", test.expr, e, got, test.want)
+		}
+	}
+}
+
+func TestBadLabelExpr(t *testing.T) {
+	for _, expr := range []string{"", "a &&", "(a || b", "a b", "a & b", "@", "a || -b"} {
+		if _, err := ParseLabelExpr(Label(expr)); err == nil {
+			t.Errorf("%q: expected an error", expr)
+		}
+	}
+}
+
+func TestAnyLabelExpr(t *testing.T) {
+	e, err := ParseLabelExpr(AnyLabel)
+	if err != nil || !e.Matches(nil) {
+		t.Errorf("AnyLabel should match everything")
+	}
+}
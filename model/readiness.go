@@ -0,0 +1,99 @@
+package model
+
+import (
+	"fmt"
+	"net/url"
+	"regexp"
+	"strings"
+	"time"
+)
+
+// DefaultWaitTimeout is how long to wait for a block's @waitFor
+// condition if the block doesn't say.
+const DefaultWaitTimeout = 30 * time.Second
+
+// Kinds of readiness condition.
+const (
+	ReadyTCP    = "tcp"    // A TCP address accepts connections.
+	ReadyFile   = "file"   // A file exists, relative to the block's @dir if need be.
+	ReadyHTTP   = "http"   // A URL answers with a 2xx status.
+	ReadyStdout = "stdout" // The shell prints a line matching a pattern.
+)
+
+// Readiness is a condition to wait for after a block finishes, before
+// moving on, e.g. a server the block started accepting connections.
+// It's given by a @waitFor attribute, e.g.
+//
+//	@waitFor=tcp:localhost:8000
+//	@waitFor=file:/tmp/ready
+//	@waitFor=http://localhost:8080/healthz
+//	@waitFor=stdout:/Listening on/
+type Readiness struct {
+	Kind    string
+	Target  string         // Address, file name or URL; the pattern for stdout.
+	Pattern *regexp.Regexp // Compiled Target, for stdout.
+}
+
+// ParseReadiness parses the value of a @waitFor attribute.
+func ParseReadiness(value string) (*Readiness, error) {
+	if strings.HasPrefix(value, "http://") || strings.HasPrefix(value, "https://") {
+		u, err := url.Parse(value)
+		if err != nil || u.Host == "" {
+			return nil, fmt.Errorf("@%s needs a URL like http://localhost:8080/, got %q", AttrWaitFor, value)
+		}
+		return &Readiness{ReadyHTTP, value, nil}, nil
+	}
+	i := strings.Index(value, ":")
+	if i < 0 || i == len(value)-1 {
+		return nil, fmt.Errorf(
+			"@%s needs tcp:host:port, file:path, a URL or stdout:/pattern/, got %q", AttrWaitFor, value)
+	}
+	kind, target := value[:i], value[i+1:]
+	switch kind {
+	case ReadyTCP:
+		if !strings.Contains(target, ":") {
+			return nil, fmt.Errorf("@%s needs tcp:host:port, got %q", AttrWaitFor, value)
+		}
+	case ReadyFile:
+	case ReadyStdout:
+		if len(target) < 3 || target[0] != '/' || target[len(target)-1] != '/' {
+			return nil, fmt.Errorf("@%s needs stdout:/pattern/, got %q", AttrWaitFor, value)
+		}
+		target = target[1 : len(target)-1]
+		re, err := regexp.Compile(target)
+		if err != nil {
+			return nil, fmt.Errorf("@%s has a bad pattern: %v", AttrWaitFor, err)
+		}
+		return &Readiness{kind, target, re}, nil
+	default:
+		return nil, fmt.Errorf(
+			"@%s needs tcp:host:port, file:path, a URL or stdout:/pattern/, got %q", AttrWaitFor, value)
+	}
+	return &Readiness{kind, target, nil}, nil
+}
+
+func (r *Readiness) String() string {
+	if r.Kind == ReadyHTTP {
+		return r.Target
+	}
+	if r.Kind == ReadyStdout {
+		return r.Kind + ":/" + r.Target + "/"
+	}
+	return r.Kind + ":" + r.Target
+}
+
+// NotReadyError reports that a block's readiness condition wasn't met
+// in time.
+type NotReadyError struct {
+	Readiness *Readiness
+	Timeout   time.Duration
+	Reason    error // Why the last check failed, if known.
+}
+
+func (e *NotReadyError) Error() string {
+	msg := fmt.Sprintf("readiness never reached: %s not ready after %v", e.Readiness, e.Timeout)
+	if e.Reason != nil {
+		msg += " (" + e.Reason.Error() + ")"
+	}
+	return msg
+}
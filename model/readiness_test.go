@@ -0,0 +1,39 @@
+package model
+
+import (
+	"strings"
+	"testing"
+)
+
+func TestParseReadiness(t *testing.T) {
+	for _, c := range []struct {
+		value, kind, target, err string
+	}{
+		{"tcp:localhost:8000", ReadyTCP, "localhost:8000", ""},
+		{"file:/tmp/ready", ReadyFile, "/tmp/ready", ""},
+		{"http://localhost:8080/healthz", ReadyHTTP, "http://localhost:8080/healthz", ""},
+		{"https://example.com/", ReadyHTTP, "https://example.com/", ""},
+		{"stdout:/Listening on/", ReadyStdout, "Listening on", ""},
+		{"tcp:8000", "", "", "needs tcp:host:port"},
+		{"stdout:Listening", "", "", "needs stdout:/pattern/"},
+		{"stdout:/(/", "", "", "bad pattern"},
+		{"http://", "", "", "needs a URL"},
+		{"port:80", "", "", "needs tcp:host:port, file:path"},
+		{"soon", "", "", "needs tcp:host:port, file:path"},
+	} {
+		r, err := ParseReadiness(c.value)
+		if c.err != "" {
+			if err == nil || !strings.Contains(err.Error(), c.err) {
+				t.Errorf("%q: expected error %q, got %v", c.value, c.err, err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: unexpected error %v", c.value, err)
+			continue
+		}
+		if r.Kind != c.kind || r.Target != c.target || r.String() != c.value {
+			t.Errorf("%q: got %s %q (%s)", c.value, r.Kind, r.Target, r)
+		}
+	}
+}
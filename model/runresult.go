@@ -4,6 +4,7 @@ import (
 	"fmt"
 	"os"
 	"strings"
+	"time"
 )
 
 type status int
@@ -11,6 +12,7 @@ type status int
 const (
 	yep status = iota
 	nope
+	notRun
 )
 
 // BlockOutput pairs success status (yes or no) with the output
@@ -21,24 +23,55 @@ const (
 // Output can appear on stderr without neccessarily being associated
 // with shell failure, so it's collected even in successful runs.
 type BlockOutput struct {
-	success status
-	output  string
+	success  status
+	output   string
+	omitted  int // Bytes left out of output, to keep it to size.
+	exitCode int // Exit status the block reported, if it succeeded.
 }
 
 func (x BlockOutput) Succeeded() bool {
 	return x.success == yep
 }
 
+// Skipped is true if the block never ran, e.g. because an earlier
+// block failed.
+func (x BlockOutput) Skipped() bool {
+	return x.success == notRun
+}
+
 func (x BlockOutput) Output() string {
 	return x.output
 }
 
+// Omitted returns the number of bytes left out of the middle of the
+// output, if it was too long to keep whole.
+func (x BlockOutput) Omitted() int {
+	return x.omitted
+}
+
+func (x *BlockOutput) SetOmitted(n int) *BlockOutput {
+	x.omitted = n
+	return x
+}
+
+// SetExitCode records the exit status a block reported on finishing,
+// which isn't necessarily zero, e.g. for a block ending in
+// "test -f x && rm x", which doesn't stop a shell running with -e.
+func (x *BlockOutput) SetExitCode(c int) *BlockOutput {
+	x.exitCode = c
+	return x
+}
+
 func NewFailureOutput(output string) *BlockOutput {
-	return &BlockOutput{nope, output}
+	return &BlockOutput{nope, output, 0, UnknownExitCode}
 }
 
 func NewSuccessOutput(output string) *BlockOutput {
-	return &BlockOutput{yep, output}
+	return &BlockOutput{yep, output, 0, 0}
+}
+
+func NewSkippedOutput() *BlockOutput {
+	return &BlockOutput{notRun, "", 0, UnknownExitCode}
 }
 
 // RunResult pairs BlockOutput with meta data about shell execution.
@@ -49,12 +82,33 @@ type RunResult struct {
 	block    *CommandBlock // Content of actual command block.
 	problem  error         // Error, if any.
 	message  string        // Detailed error message, if any.
+	start    time.Time     // When the block started.
+	duration time.Duration // Time taken to run the block.
+	exitCode int           // Block's exit status, or UnknownExitCode.
 }
 
+// UnknownExitCode is the exit code of a block that never ran, or
+// that was killed before its status could be taken.
+const UnknownExitCode = -1
+
 func NewRunResult() *RunResult {
 	noLabels := []Label{}
 	blockOutput := NewFailureOutput("")
-	return &RunResult{*blockOutput, "", -1, NewCommandBlock(noLabels, ""), nil, ""}
+	return &RunResult{
+		*blockOutput, "", -1, NewCommandBlock(noLabels, ""), nil, "",
+		time.Time{}, 0, UnknownExitCode}
+}
+
+// NewBlockRunResult returns the result of running, or skipping, the
+// index'th block from the given file.
+func NewBlockRunResult(
+	blockOutput *BlockOutput, fileName FileName, index int, block *CommandBlock) *RunResult {
+	exitCode := UnknownExitCode
+	if blockOutput.Succeeded() {
+		exitCode = blockOutput.exitCode
+	}
+	return &RunResult{
+		*blockOutput, fileName, index, block, nil, "", time.Time{}, 0, exitCode}
 }
 
 // For tests.
@@ -63,7 +117,8 @@ func NoCommandsRunResult(
 	noLabels := []Label{}
 	return &RunResult{
 		*blockOutput, fileName, index,
-		NewCommandBlock(noLabels, ""), nil, message}
+		NewCommandBlock(noLabels, ""), nil, message,
+		time.Time{}, 0, UnknownExitCode}
 }
 
 func (x *RunResult) FileName() FileName {
@@ -102,6 +157,41 @@ func (x *RunResult) SetIndex(i int) *RunResult {
 	return x
 }
 
+func (x *RunResult) Block() *CommandBlock {
+	return x.block
+}
+
+func (x *RunResult) Duration() time.Duration {
+	return x.duration
+}
+
+func (x *RunResult) SetDuration(d time.Duration) *RunResult {
+	x.duration = d
+	return x
+}
+
+// Start returns when the block started, or the zero time if it never
+// ran.
+func (x *RunResult) Start() time.Time {
+	return x.start
+}
+
+func (x *RunResult) SetStart(t time.Time) *RunResult {
+	x.start = t
+	return x
+}
+
+// ExitCode returns the block's exit status, e.g. 127 for command not
+// found, or UnknownExitCode.
+func (x *RunResult) ExitCode() int {
+	return x.exitCode
+}
+
+func (x *RunResult) SetExitCode(c int) *RunResult {
+	x.exitCode = c
+	return x
+}
+
 func (x *RunResult) SetBlock(b *CommandBlock) *RunResult {
 	x.block = b
 	return x
@@ -117,12 +207,44 @@ func (x *RunResult) Print(selectedLabel Label) {
 	fmt.Fprintf(os.Stderr, delim)
 	x.block.Print(os.Stderr, "Error", x.index+1, selectedLabel, x.fileName)
 	fmt.Fprintf(os.Stderr, delim)
+	fmt.Fprintf(os.Stderr, "\n%s\n", x.Status())
+	if m, ok := x.problem.(*MismatchError); ok {
+		fmt.Fprintf(os.Stderr, "\n%s", m.Error())
+	}
 	printCapturedOutput("Stdout", delim, x.output)
 	if len(x.message) > 0 {
 		printCapturedOutput("Stderr", delim, x.message)
 	}
 }
 
+// Status describes how the block ended, e.g.
+// "exit status 127 (command not found) after 1.2s".
+func (x *RunResult) Status() string {
+	var status string
+	switch {
+	case x.Skipped():
+		return "not run"
+	case x.exitCode == UnknownExitCode:
+		status = "unknown exit status"
+	default:
+		status = fmt.Sprintf("exit status %d", x.exitCode)
+		if meaning := exitCodeMeanings[x.exitCode]; meaning != "" {
+			status += " (" + meaning + ")"
+		} else if x.exitCode > 128 {
+			status += fmt.Sprintf(" (signal %d)", x.exitCode-128)
+		}
+	}
+	return status + " after " + x.duration.Round(time.Millisecond).String()
+}
+
+// exitCodeMeanings explains exit codes with conventional meanings in
+// bash.
+var exitCodeMeanings = map[int]string{
+	2:   "misuse of shell builtin",
+	126: "command not executable",
+	127: "command not found",
+}
+
 func printCapturedOutput(name, delim, output string) {
 	fmt.Fprintf(os.Stderr, "\n%s capture:\n", name)
 	fmt.Fprintf(os.Stderr, delim)
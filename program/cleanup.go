@@ -0,0 +1,147 @@
+package program
+
+import (
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/scanner"
+)
+
+// cleanupFunc names the shell function that runs a shell's cleanup
+// blocks (see model.CleanupLabel).  If defined, exitTrap calls it, so
+// that cleanup happens however the shell exits: after the last block,
+// a failure, or a TERM because a block timed out or mdrip was
+// interrupted.
+const cleanupFunc = "mdrip_cleanup"
+
+// writeCleanup writes the function that runs the given cleanup blocks
+// in document order.  They run in the shell itself, so that they can
+// use its variables and jobs, e.g. "kill %1", but with errexit off,
+// so that a failing command doesn't stop them.  A block's exit status
+// is that of its last command.  Each block's output, bracketed by
+// lines announcing its start and exit status, is appended to the
+// named log.  A block that calls exit ends the cleanup.
+func (p *Program) writeCleanup(sw *scriptWriter, blocks []*model.CommandBlock, logName string) {
+	sw.emit(cleanupFunc + "() {\n")
+	for i, b := range blocks {
+		// In case an earlier block turned errexit back on.
+		sw.emit("set +e\n")
+		sw.emit(fmt.Sprintf("echo %s %d $EPOCHREALTIME\n", sentinel(scanner.MsgCleanup), i))
+		sw.emit("{\n")
+		p.wrapBlock(sw, i, b)
+		sw.emit("}\n")
+		// The block's output may not end a line, so end one.
+		sw.emit(fmt.Sprintf("echo; echo %s $mdrip_status $EPOCHREALTIME\n",
+			sentinel(scanner.MsgCleanupDone)))
+	}
+	sw.emit(fmt.Sprintf("} >>'%s' 2>&1\n", logName))
+}
+
+// cleanupTime returns the time allowed for the given cleanup blocks
+// to run.
+func (p *Program) cleanupTime(blocks []*model.CommandBlock) time.Duration {
+	total := time.Duration(0)
+	for _, b := range blocks {
+		t := b.Timeout()
+		if t == 0 {
+			t = p.blockTimeout
+		}
+		total += t
+	}
+	return total
+}
+
+// cleanupResults returns a result for each of the shell's cleanup
+// blocks, read from its log once the shell has exited, keeping at
+// most maxOutput bytes of each block's output.  Blocks are located in
+// the given scripts.
+func (s *session) cleanupResults(scripts []*model.Script, maxOutput int) []*model.RunResult {
+	if len(s.cleanups) == 0 {
+		return nil
+	}
+	contents, _ := ioutil.ReadFile(s.cleanupLog)
+	// Sentinels only count at the start of a line.  The first section
+	// precedes the first block's announcement.
+	sections := strings.Split("\n"+string(contents), "\n"+s.sentinels.Cleanup+" ")[1:]
+	results := []*model.RunResult{}
+	for i, block := range s.cleanups {
+		fileName, index := locate(scripts, block)
+		if i >= len(sections) {
+			results = append(results, model.NewBlockRunResult(
+				model.NewSkippedOutput(), fileName, index, block))
+			continue
+		}
+		// The section holds "i start\n", the block's output, then
+		// "\nCleanupDone status end\n" (see scanner.Sentinels).
+		section := sections[i]
+		header := section
+		if j := strings.Index(section, "\n"); j > -1 {
+			header, section = section[:j], section[j+1:]
+		}
+		start := epochTime(header)
+		done := strings.Index(section, "\n"+s.sentinels.CleanupDone)
+		if done < 0 {
+			output := scanner.Truncate(s.smap.rewrite(section), maxOutput)
+			results = append(results, model.NewBlockRunResult(
+				model.NewFailureOutput(output), fileName, index, block).
+				SetProblem(errors.New("cleanup block did not finish")).
+				SetStart(start).SetDuration(time.Since(start)))
+			continue
+		}
+		output := scanner.Truncate(s.smap.rewrite(section[:done]), maxOutput)
+		fields := strings.Fields(section[done+1+len(s.sentinels.CleanupDone):])
+		code := model.UnknownExitCode
+		end := time.Time{}
+		if len(fields) > 0 {
+			if c, err := strconv.Atoi(fields[0]); err == nil {
+				code = c
+			}
+			end = epochTime(strings.Join(fields, " "))
+		}
+		r := model.NewBlockRunResult(model.NewSuccessOutput(output), fileName, index, block)
+		if code != 0 {
+			r = model.NewBlockRunResult(model.NewFailureOutput(output), fileName, index, block).
+				SetProblem(fmt.Errorf("cleanup block failed with exit status %d", code))
+		}
+		r.SetExitCode(code).SetStart(start)
+		if !start.IsZero() && !end.IsZero() {
+			r.SetDuration(end.Sub(start))
+		}
+		results = append(results, r)
+	}
+	return results
+}
+
+// epochTime returns the time given as seconds since the epoch, e.g.
+// by bash's EPOCHREALTIME, in the last field of the given text, or
+// the zero time if there's no such field (e.g. in old versions of
+// bash).
+func epochTime(text string) time.Time {
+	fields := strings.Fields(text)
+	if len(fields) < 2 {
+		return time.Time{}
+	}
+	seconds, err := strconv.ParseFloat(fields[len(fields)-1], 64)
+	if err != nil {
+		return time.Time{}
+	}
+	return time.Unix(0, int64(seconds*float64(time.Second)))
+}
+
+// locate returns the file holding the given block, and its index in
+// that file's script.
+func locate(scripts []*model.Script, block *model.CommandBlock) (model.FileName, int) {
+	for _, script := range scripts {
+		for i, b := range script.Blocks() {
+			if b == block {
+				return script.FileName(), i
+			}
+		}
+	}
+	return block.FileName(), -1
+}
@@ -0,0 +1,149 @@
+package program
+
+import (
+	"encoding/json"
+	"io"
+	"os/exec"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/model"
+)
+
+// Event actions, in the order they occur in a run.
+const (
+	ActionStart  = "start"  // The run has begun.
+	ActionRun    = "run"    // A block has begun.
+	ActionOutput = "output" // A block wrote a line.
+	ActionPass   = "pass"   // A block succeeded.
+	ActionFail   = "fail"   // A block failed.
+	ActionSkip   = "skip"   // A block didn't run, since an earlier block failed.
+	ActionEnd    = "end"    // The run has ended.
+)
+
+// Event is one step of a test run, in the manner of "go test -json".
+type Event struct {
+	Time     time.Time `json:"time"`
+	Action   string    `json:"action"`
+	File     string    `json:"file,omitempty"`
+	Block    string    `json:"block,omitempty"`
+	Language string    `json:"language,omitempty"` // The block's fence language, if any.
+	Line     int       `json:"line,omitempty"`
+	Stream   string    `json:"stream,omitempty"`
+	Output   string    `json:"output,omitempty"`
+	Elapsed  *float64  `json:"elapsed,omitempty"`  // Seconds.
+	ExitCode *int      `json:"exitCode,omitempty"` // Only on pass, fail and end, if known.
+	Blocks   int       `json:"blocks,omitempty"`   // Only on start.
+	Message  string    `json:"message,omitempty"`
+}
+
+// eventLog writes events as newline-delimited JSON.  Output events
+// arrive from both the stdout and stderr accumulators, so writes are
+// serialized.  A nil eventLog discards events.
+type eventLog struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func newEventLog(w io.Writer) *eventLog {
+	return &eventLog{enc: json.NewEncoder(w)}
+}
+
+func (l *eventLog) emit(e Event) {
+	if l == nil {
+		return
+	}
+	e.Time = time.Now()
+	l.mu.Lock()
+	defer l.mu.Unlock()
+	if err := l.enc.Encode(e); err != nil {
+		glog.Warningf("Unable to write event: %v", err)
+	}
+}
+
+// blockEvent returns an event about the given block.
+func blockEvent(action string, fileName model.FileName, b *model.CommandBlock) Event {
+	return Event{
+		Action:   action,
+		File:     string(fileName),
+		Block:    b.Name().String(),
+		Language: b.Language(),
+		Line:     b.FirstLine(),
+	}
+}
+
+// resultEvent returns a pass, fail or skip event for the given result.
+func resultEvent(r *model.RunResult) Event {
+	if r.Skipped() {
+		return blockEvent(ActionSkip, r.FileName(), r.Block())
+	}
+	action := ActionPass
+	if !r.Succeeded() {
+		action = ActionFail
+	}
+	e := blockEvent(action, r.FileName(), r.Block())
+	elapsed := r.Duration().Seconds()
+	e.Elapsed = &elapsed
+	if code := r.ExitCode(); code != model.UnknownExitCode {
+		e.ExitCode = &code
+	}
+	if r.Problem() != nil {
+		e.Message = r.Problem().Error()
+	}
+	return e
+}
+
+// SetEventStream arranges for RunInSubShell to write an Event to w
+// at every step of the run.
+func (p *Program) SetEventStream(w io.Writer) *Program {
+	p.events = newEventLog(w)
+	return p
+}
+
+// outputEvents returns a function emitting an output event for a
+// line from the given stream of the index'th block (not counting
+// cleanup blocks), or nil if events aren't wanted.  Lines are
+// rewritten by smap, if not nil.
+func (p *Program) outputEvents(
+	scripts []*model.Script, stream string, smap *sourceMap) func(int, string) {
+	if p.events == nil {
+		return nil
+	}
+	type ref struct {
+		fileName model.FileName
+		block    *model.CommandBlock
+	}
+	refs := []ref{}
+	for _, script := range scripts {
+		for _, block := range script.Blocks() {
+			if !block.Cleanup() {
+				refs = append(refs, ref{script.FileName(), block})
+			}
+		}
+	}
+	return func(index int, line string) {
+		e := Event{Action: ActionOutput}
+		if index < len(refs) {
+			e = blockEvent(ActionOutput, refs[index].fileName, refs[index].block)
+		}
+		e.Stream = stream
+		e.Output = line
+		if smap != nil {
+			e.Output = smap.rewrite(line)
+		}
+		p.events.emit(e)
+	}
+}
+
+// exitCode returns the exit status of a process given the error
+// from waiting on it.
+func exitCode(err error) int {
+	if err == nil {
+		return 0
+	}
+	if e, ok := err.(*exec.ExitError); ok {
+		return e.ExitCode()
+	}
+	return -1
+}
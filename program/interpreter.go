@@ -0,0 +1,35 @@
+package program
+
+import (
+	"strings"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// defaultInterpreters maps fence languages to commands that read a
+// program from stdin.
+var defaultInterpreters = map[string]string{
+	"python":     "python3 -",
+	"python3":    "python3 -",
+	"py":         "python3 -",
+	"node":       "node -",
+	"js":         "node -",
+	"javascript": "node -",
+	"ruby":       "ruby -",
+	"rb":         "ruby -",
+	"perl":       "perl -",
+	"pl":         "perl -",
+}
+
+// interpreterFor returns the command that should run the given block
+// as a separate process.  The boolean is false if the block should
+// instead run directly in the shell, e.g. a bash block or a block
+// naming no language.
+func (p *Program) interpreterFor(b *model.CommandBlock) (string, bool) {
+	language := strings.ToLower(b.Language())
+	if command, ok := p.interpreters[language]; ok {
+		return command, true
+	}
+	command, ok := defaultInterpreters[language]
+	return command, ok
+}
@@ -9,9 +9,12 @@ import (
 	"io/ioutil"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
+	"regexp"
 	"strconv"
 	"strings"
+	"sync"
+	"syscall"
 	"time"
 
 	"github.com/golang/glog"
@@ -25,7 +28,18 @@ import (
 type Program struct {
 	blockTimeout time.Duration
 	label        model.Label
+	selector     model.LabelExpr
+	languages    []string
+	interpreters map[string]string
+	prompt       *regexp.Regexp // Prompt starting commands in terminal sessions.
 	fileNames    []model.FileName
+	stdin        []byte             // Markdown read from stdin, if any.
+	results      []*model.RunResult // Results of the last run.
+	events       *eventLog          // Where to report run events, if anywhere.
+	keepGoing    bool               // Whether to carry on past a failure.
+	update       bool               // Whether to accept unexpected output.
+	maxOutput    int                // Most bytes of output kept per block and stream.
+	reaped       []util.Process     // Processes killed in the last run.
 	Scripts      []*model.Script
 }
 
@@ -46,24 +60,86 @@ var templates = template.Must(
 	template.New("main").Parse(
 		model.TmplBodyCommandBlock + model.TmplBodyScript + tmplBodyProgram))
 
+// NewProgram returns a program holding the blocks selected by label,
+// which may be a boolean expression over labels (see
+// model.ParseLabelExpr).
 func NewProgram(timeout time.Duration, label model.Label, fileNames []model.FileName) *Program {
-	return &Program{timeout, label, fileNames, []*model.Script{}}
+	selector, err := model.ParseLabelExpr(label)
+	if err != nil {
+		glog.Fatal(err)
+	}
+	prompt, _ := lexer.NewPrompt(lexer.DefaultPrompt)
+	return &Program{
+		timeout, label, selector, nil, nil, prompt, fileNames,
+		nil, nil, nil, false, false, scanner.DefaultMaxOutput, nil, []*model.Script{}}
+}
+
+const (
+	// stdinArg, as a file name argument, means read markdown from stdin.
+	stdinArg = model.FileName("-")
+	// stdinName is the name given to stdin in reports.
+	stdinName = model.FileName("<stdin>")
+)
+
+// readFile returns the contents of the named file, along with the
+// name to use in reports.  Stdin is read only once, so that the
+// program may be reloaded.
+func (p *Program) readFile(fileName model.FileName) (model.FileName, []byte, error) {
+	if fileName != stdinArg {
+		contents, err := ioutil.ReadFile(string(fileName))
+		return fileName, contents, err
+	}
+	if p.stdin == nil {
+		contents, err := ioutil.ReadAll(os.Stdin)
+		if err != nil {
+			return stdinName, nil, err
+		}
+		p.stdin = contents
+	}
+	return stdinName, p.stdin, nil
+}
+
+// SetLanguages limits the program to blocks whose code fence names
+// one of the given languages, or no language at all.  A nil slice
+// means blocks in any language.
+func (p *Program) SetLanguages(languages []string) *Program {
+	p.languages = languages
+	return p
 }
 
 // Build program code from blocks extracted from markdown files.
-func (p *Program) Reload() {
+//
+// Blocks are extracted from as much of the markdown as can be read
+// and parsed.  The returned error, if non-nil, describes any file that
+// could not be read, and any markdown that could not be parsed (see
+// lexer.ErrorList), one problem per line.  Such problems may leave no
+// blocks at all; callers should check ScriptCount.  Only if there are
+// no blocks and no problems to say why does Reload exit.
+func (p *Program) Reload() error {
 	p.Scripts = []*model.Script{}
-	for _, fileName := range p.fileNames {
-		contents, err := ioutil.ReadFile(string(fileName))
+	var problems []string
+	for _, arg := range p.fileNames {
+		fileName, contents, err := p.readFile(arg)
 		if err != nil {
-			glog.Warning("Unable to read file \"%s\".", fileName)
+			problems = append(problems, fmt.Sprintf("Unable to read %s: %v", fileName, err))
+			continue
 		}
-		m := lexer.Parse(string(contents))
-		if blocks, ok := m[p.label]; ok {
+		m, err := lexer.ParseWithPrompt(fileName, string(contents), p.prompt)
+		if list, ok := err.(lexer.ErrorList); ok {
+			for _, e := range list {
+				problems = append(problems, e.Error())
+			}
+		} else if err != nil {
+			problems = append(problems, err.Error())
+		}
+		if blocks := p.filterLanguages(p.selectBlocks(m[model.AnyLabel])); len(blocks) > 0 {
 			p.Add(model.NewScript(fileName, blocks))
 		}
 	}
 
+	if len(problems) > 0 {
+		return errors.New(strings.Join(problems, "\n"))
+	}
 	if p.ScriptCount() < 1 {
 		if p.label.IsAny() {
 			glog.Fatal("No blocks found in the given files.")
@@ -71,6 +147,52 @@ func (p *Program) Reload() {
 			glog.Fatalf("No blocks labelled %q found in the given files.", p.label)
 		}
 	}
+	return nil
+}
+
+// SetInterpreters maps fence languages to commands that, in
+// RunInSubShell, read and run a block's code from stdin as a separate
+// process, e.g. "python" to "python3 -".  These supplement and
+// override the defaults.
+func (p *Program) SetInterpreters(interpreters map[string]string) *Program {
+	p.interpreters = make(map[string]string)
+	for language, command := range interpreters {
+		p.interpreters[strings.ToLower(language)] = command
+	}
+	return p
+}
+
+// SetPrompt sets the pattern recognizing the prompts that start
+// commands in blocks holding a terminal session (see
+// lexer.ParseWithPrompt).
+func (p *Program) SetPrompt(prompt *regexp.Regexp) *Program {
+	p.prompt = prompt
+	return p
+}
+
+// selectBlocks returns the blocks whose labels satisfy the program's
+// label expression.
+func (p *Program) selectBlocks(blocks []*model.CommandBlock) []*model.CommandBlock {
+	result := []*model.CommandBlock{}
+	for _, b := range blocks {
+		if p.selector.Matches(b.Labels()) {
+			result = append(result, b)
+		}
+	}
+	return result
+}
+
+func (p *Program) filterLanguages(blocks []*model.CommandBlock) []*model.CommandBlock {
+	if p.languages == nil {
+		return blocks
+	}
+	result := []*model.CommandBlock{}
+	for _, b := range blocks {
+		if b.HasLanguage(p.languages) {
+			result = append(result, b)
+		}
+	}
+	return result
 }
 
 func (p *Program) Add(s *model.Script) *Program {
@@ -87,6 +209,12 @@ func (p *Program) ScriptCount() int {
 	return len(p.Scripts)
 }
 
+// Results returns a result for every block of the last run, in order
+// of execution.  Blocks following a failure are marked skipped.
+func (p *Program) Results() []*model.RunResult {
+	return p.results
+}
+
 // PrintNormal simply prints the contents of a program.
 func (p Program) PrintNormal(w io.Writer) {
 	for _, s := range p.Scripts {
@@ -143,7 +271,7 @@ func check(msg string, err error) {
 //
 // To do so, it accumulates strings off a channel representing command
 // block output until the channel closes, or until a string arrives
-// that matches a particular pattern.
+// that starts with one of the given sentinels.
 //
 // On the happy path, strings are accumulated and every so often sent
 // out with a success == true flag attached.  This continues until the
@@ -152,46 +280,126 @@ func check(msg string, err error) {
 // On a sad path, an accumulation of strings is sent with a success ==
 // false flag attached, and the function exits early, before it's
 // input channel closes.
-func accumulateOutput(prefix string, in <-chan string) <-chan *model.BlockOutput {
+//
+// The nth element of timeouts, if present, is how long to wait for
+// the nth success before treating the block as timed out.  The clock
+// starts when the previous block succeeds or, if gated, when the shell
+// announces that the block is starting, having waited for its turn.
+// A value on detach stops the clock of the current block, which is
+// left running alongside those that follow (see awaitBlock).
+// If onLine isn't nil, it's called with the index of the block and
+// each line of its output as the line arrives.
+//
+// The success sentinel follows a line end of its own (see writeBlock),
+// so the last line end before it isn't the block's, and output that
+// doesn't end a line is kept as is.  Line ends, and the empty lines
+// they make, are held back until it's known whether the sentinel
+// follows.
+//
+// At most maxOutput bytes of each block's output are kept (see
+// scanner.Capture), or all of it if maxOutput is zero.
+func accumulateOutput(
+	prefix string, in <-chan scanner.Line, sentinels *scanner.Sentinels, maxOutput int,
+	timeouts []time.Duration, gated bool, detach <-chan bool,
+	onLine func(int, string)) <-chan *model.BlockOutput {
 	out := make(chan *model.BlockOutput)
-	var accum bytes.Buffer
+	accum := scanner.NewCapture(maxOutput)
 	go func() {
 		defer close(out)
-		for line := range in {
-			if strings.HasPrefix(line, scanner.MsgTimeout) {
-				accum.WriteString("\n" + line + "\n")
-				accum.WriteString("A subprocess might still be running.\n")
+		block := 0
+		ends := 0   // Line ends held back.
+		blanks := 0 // Empty lines held back, which the last ends make.
+		release := func() {
+			accum.WriteString(strings.Repeat("\n", ends))
+			ends = 0
+			for ; blanks > 0; blanks-- {
+				if onLine != nil {
+					onLine(block, "")
+				}
+			}
+		}
+		var deadline <-chan time.Time
+		startClock := func() {
+			deadline = nil
+			if block < len(timeouts) && !gated {
+				deadline = time.After(timeouts[block])
+			}
+		}
+		startClock()
+		for {
+			next, ok := scanner.Line{}, true
+			select {
+			case next, ok = <-in:
+			case <-deadline:
+				next = scanner.Line{Text: sentinels.Timeout}
+			case <-detach:
+				// The block is left running; see awaitBlock.
+				deadline = nil
+				continue
+			}
+			if !ok {
+				break
+			}
+			line := next.Text
+			if strings.HasPrefix(line, sentinels.Timeout) {
 				if glog.V(2) {
 					glog.Info("accumulateOutput %s: Timeout return.", prefix)
 				}
-				out <- model.NewFailureOutput(accum.String())
+				release()
+				// The sentinel is added after truncation, so as to be kept.
+				out <- model.NewFailureOutput(accum.String() + "\n" + line + "\n")
 				return
 			}
-			if strings.HasPrefix(line, scanner.MsgError) {
-				accum.WriteString(line + "\n")
+			if strings.HasPrefix(line, sentinels.Error) {
 				if glog.V(2) {
 					glog.Info("accumulateOutput %s: Error return.", prefix)
 				}
-				out <- model.NewFailureOutput(accum.String())
+				release()
+				out <- model.NewFailureOutput(accum.String() + line + "\n")
 				return
 			}
-			if strings.HasPrefix(line, scanner.MsgHappy) {
+			if strings.HasPrefix(line, sentinels.Start) {
+				if block < len(timeouts) {
+					deadline = time.After(timeouts[block])
+				}
+				continue
+			}
+			if strings.HasPrefix(line, sentinels.Happy) {
 				if glog.V(2) {
 					glog.Info("accumulateOutput %s: %s", prefix, line)
 				}
-				out <- model.NewSuccessOutput(accum.String())
+				if ends > 0 {
+					ends--
+					if blanks > 0 {
+						blanks--
+					}
+				}
+				release()
+				out <- model.NewSuccessOutput(accum.String()).SetOmitted(accum.Omitted()).
+					SetExitCode(happyStatus(line, sentinels))
 				accum.Reset()
+				block++
+				startClock()
+			} else if line == "" {
+				ends++
+				blanks++
 			} else {
 				if glog.V(2) {
 					glog.Info("accumulateOutput %s: Accumulating [%s]", prefix, line)
 				}
-				accum.WriteString(line + "\n")
+				release()
+				accum.WriteLine(next)
+				ends = 1
+				if onLine != nil {
+					onLine(block, line)
+				}
 			}
 		}
 
 		if glog.V(2) {
 			glog.Info("accumulateOutput %s: <--- This channel has closed.", prefix)
 		}
+		release()
 		trailing := strings.TrimSpace(accum.String())
 		if len(trailing) > 0 {
 			if glog.V(2) {
@@ -209,6 +417,20 @@ func accumulateOutput(prefix string, in <-chan string) <-chan *model.BlockOutput
 	return out
 }
 
+// happyStatus returns the exit status in the given success sentinel
+// line, "Happy status name" (see writeBlock).
+func happyStatus(line string, sentinels *scanner.Sentinels) int {
+	fields := strings.Fields(strings.TrimPrefix(line, sentinels.Happy))
+	if len(fields) == 0 {
+		return model.UnknownExitCode
+	}
+	code, err := strconv.Atoi(fields[0])
+	if err != nil {
+		return model.UnknownExitCode
+	}
+	return code
+}
+
 // userBehavior acts like a command line user.
 //
 // TODO(monopole): update the comments, as this function no longer writes to stdin.
@@ -217,54 +439,321 @@ func accumulateOutput(prefix string, in <-chan string) <-chan *model.BlockOutput
 // It writes command blocks to shell, then waits after  each block to
 // see if the block worked.  If the block appeared to complete without
 // error, the routine sends the next block, else it exits early.
-func (p *Program) userBehavior(stdOut, stdErr io.ReadCloser) (errResult *model.RunResult) {
-
-	chOut := scanner.BuffScanner(p.blockTimeout, "stdout", stdOut)
-	chErr := scanner.BuffScanner(1*time.Minute, "stderr", stdErr)
+//
+// Each block runs in the given shell it names, after that shell is
+// given its turn.  A block left running (see awaitBlock) is stopped
+// once the other blocks are done.
+//
+// A result for every block of the given scripts, including those
+// skipped after a failure, is appended to p.results.
+func (p *Program) userBehavior(
+	scripts []*model.Script, shells []*session) (errResult *model.RunResult) {
 
-	chAccOut := accumulateOutput("stdOut", chOut)
-	chAccErr := accumulateOutput("stdErr", chErr)
+	// Blocks are timed individually as their output is accumulated, so
+	// the stdout scanner should only give up on a stream that's idle for
+	// longer than any block is allowed to run, and the stderr scanner
+	// only on a stream that's idle for the whole run.  A shell waiting
+	// for its turn may be idle for the whole run too.
+	timeouts := p.blockTimeouts(scripts)
+	maxTimeout := p.blockTimeout
+	totalTimeout := 1 * time.Minute
+	for _, t := range timeouts {
+		if t > maxTimeout {
+			maxTimeout = t
+		}
+		totalTimeout += t
+	}
+	for _, script := range scripts {
+		for _, block := range script.Blocks() {
+			if block.WaitFor() != nil {
+				totalTimeout += block.WaitTimeout()
+			}
+		}
+	}
+	for _, s := range shells {
+		gated := s.gate != nil
+		idle := maxTimeout
+		if gated {
+			idle = totalTimeout
+		}
+		s.chOut = scanner.BuffScanner(idle, "stdout", s.stdOut, p.maxOutput, s.sentinels)
+		chErr := scanner.BuffScanner(totalTimeout, "stderr", s.stdErr, p.maxOutput, s.sentinels)
+		s.chAccOut = accumulateOutput("stdOut", s.chOut, s.sentinels, p.maxOutput,
+			p.blockTimeouts(s.scripts), gated, s.detach, s.watch(p.outputEvents(s.scripts, "stdout", nil)))
+		s.chAccErr = accumulateOutput("stdErr", chErr, s.sentinels, p.maxOutput, nil, false, nil,
+			p.outputEvents(s.scripts, "stderr", s.smap))
+	}
 
 	errResult = model.NewRunResult()
-	for _, script := range p.Scripts {
+	failed := false
+	start := time.Now()
+	running := map[*session]*runningBlock{}
+	// record puts a block's result in the place kept for it, stopping
+	// the run if the block failed.
+	record := func(slot int, r *model.RunResult) {
+		p.results[slot] = r
+		p.events.emit(resultEvent(r))
+		if r.Problem() != nil && !failed {
+			errResult = r
+			failed = true
+			drainAll(shells)
+		}
+	}
+	for _, script := range scripts {
 		numBlocks := len(script.Blocks())
 		for i, block := range script.Blocks() {
+			if block.Cleanup() {
+				// See runInShell.
+				continue
+			}
+			s := shellFor(shells, block)
+			if b := running[s]; b != nil && !failed {
+				// The shell can't run the block until the one it left
+				// running finishes.
+				delete(running, s)
+				record(b.slot, p.finishRunning(s, b))
+			}
+			slot := len(p.results)
+			p.results = append(p.results, nil)
+			if failed {
+				record(slot, model.NewBlockRunResult(
+					model.NewSkippedOutput(), script.FileName(), i, block))
+				continue
+			}
 			glog.Info("Running %s (%d/%d) from %s\n",
 				block.Name(), i+1, numBlocks, script.FileName())
+			p.events.emit(blockEvent(ActionRun, script.FileName(), block))
 			if glog.V(2) {
 				glog.Info("userBehavior: sending \"%s\"", block.Code())
 			}
+			s.proceed()
+			result, ready := awaitBlock(block, s)
+			if ready {
+				running[s] = &runningBlock{script.FileName(), i, block, start, slot}
+				start = time.Now()
+				continue
+			}
+			r := p.blockResult(s, script.FileName(), i, block, result, false)
+			record(slot, r.SetStart(start).SetDuration(time.Since(start)))
+			start = time.Now()
+		}
+	}
+	// Blocks left running, e.g. servers, have served the blocks that
+	// followed them.
+	for _, s := range shells {
+		if b := running[s]; b != nil {
+			record(b.slot, p.stopRunning(s, b))
+		}
+	}
+	if !failed {
+		glog.Info("All done, no errors triggered.\n")
+	}
+	return
+}
 
-			result := <-chAccOut
+// blockResult returns the result of the given block, which ran in s,
+// from its stdout result, checking its expected output and, unless
+// it's known to be ready, its readiness condition.  The result has a
+// problem if the block failed any of these.
+func (p *Program) blockResult(
+	s *session, fileName model.FileName, i int, block *model.CommandBlock,
+	result *model.BlockOutput, ready bool) *model.RunResult {
+	if result == nil || !result.Succeeded() {
+		// A nil result means stdout has closed early because a
+		// sub-subprocess failed.
+		errResult := model.NewRunResult()
+		timedOut := false
+		if result == nil {
+			if glog.V(2) {
+				glog.Info("userBehavior: stdout Result == nil.")
+			}
+			// Perhaps chErr <- scanner.MsgError +
+			//   " : early termination; stdout has closed."
+		} else {
+			if glog.V(2) {
+				glog.Info("userBehavior: stdout Result: %s", result.Output())
+			}
+			timedOut = strings.Contains(result.Output(), s.sentinels.Timeout)
+			output := s.sentinels.Strip(result.Output())
+			errResult.SetOutput(output).SetMessage(output)
+		}
+		errResult.SetFileName(fileName).SetIndex(i).SetBlock(block)
+		if timedOut {
+			// The block may still be running, so its stderr is incomplete.
+			errResult.SetProblem(errors.New(scanner.MsgTimeout))
+		} else {
+			fillErrResult(s, errResult)
+		}
+		return errResult
+	}
+	r := model.NewBlockRunResult(result, fileName, i, block)
+	if stdErrResult := <-s.chAccErr; stdErrResult != nil {
+		r.SetMessage(s.smap.rewrite(stdErrResult.Output()))
+	}
+	var problem error
+	if e := block.Expectation(); e != nil && result.Omitted() > 0 {
+		// Neither a check nor an update would make sense.
+		problem = fmt.Errorf(
+			"output is too long to check against %s, as %d bytes were left out; raise --maxOutput",
+			e.Location(), result.Omitted())
+	} else if e != nil && !p.update && !e.Matches(result.Output()) {
+		// The block worked, but didn't print what the markdown says.
+		problem = &model.MismatchError{Expectation: e, Output: result.Output()}
+	} else if !ready {
+		problem = awaitReadiness(block, s)
+	}
+	if problem != nil {
+		return model.NewBlockRunResult(
+			model.NewFailureOutput(result.Output()), fileName, i, block).
+			SetMessage(r.Message()).SetExitCode(r.ExitCode()).SetProblem(problem)
+	}
+	return r
+}
 
-			if result == nil || !result.Succeeded() {
-				// A nil result means stdout has closed early because a
-				// sub-subprocess failed.
-				if result == nil {
-					if glog.V(2) {
-						glog.Info("userBehavior: stdout Result == nil.")
-					}
-					// Perhaps chErr <- scanner.MsgError +
-					//   " : early termination; stdout has closed."
-				} else {
-					if glog.V(2) {
-						glog.Info("userBehavior: stdout Result: %s", result.Output())
-					}
-					errResult.SetOutput(result.Output()).SetMessage(result.Output())
-				}
-				errResult.SetFileName(script.FileName()).SetIndex(i).SetBlock(block)
-				fillErrResult(chAccErr, errResult)
+// runningBlock is a block left running alongside the blocks that
+// follow it, e.g. a server, whose result waits in p.results[slot].
+type runningBlock struct {
+	fileName model.FileName
+	index    int
+	block    *model.CommandBlock
+	start    time.Time
+	slot     int
+}
+
+// awaitBlock waits for the given block, just started in s, to finish,
+// returning its stdout result.  A block whose readiness condition
+// holds before it finishes, e.g. a server running in the foreground,
+// is instead left running, with its clock stopped, and awaitBlock
+// returns ready.
+func awaitBlock(block *model.CommandBlock, s *session) (result *model.BlockOutput, ready bool) {
+	r := block.WaitFor()
+	if r == nil {
+		return <-s.chAccOut, false
+	}
+	done := make(chan bool)
+	defer close(done)
+	holds := make(chan bool, 1)
+	go func() {
+		for checkReadiness(r, block.Dir(), s) != nil {
+			select {
+			case <-done:
 				return
+			case <-time.After(pollInterval):
 			}
 		}
+		holds <- true
+	}()
+	select {
+	case result = <-s.chAccOut:
+		return result, false
+	case <-holds:
+		s.detach <- true
+		return nil, true
 	}
-	glog.Info("All done, no errors triggered.\n")
-	return
 }
 
-// fillErrResult fills an instance of RunResult.
-func fillErrResult(chAccErr <-chan *model.BlockOutput, errResult *model.RunResult) {
-	result := <-chAccErr
+// finishRunning waits for a block left running in s to finish, so
+// that s can run its next block.  The block's timeout, which stopped
+// when it was left running, starts again.
+func (p *Program) finishRunning(s *session, b *runningBlock) *model.RunResult {
+	timeout := b.block.Timeout()
+	if timeout == 0 {
+		timeout = p.blockTimeout
+	}
+	var result *model.BlockOutput
+	select {
+	case result = <-s.chAccOut:
+	case <-time.After(timeout):
+		result = model.NewFailureOutput(s.sentinels.Timeout + "\n")
+		go func() {
+			for range s.chAccOut {
+			}
+		}()
+	}
+	s.clearDetach()
+	r := p.blockResult(s, b.fileName, b.index, b.block, result, true)
+	return r.SetStart(b.start).SetDuration(time.Since(b.start))
+}
+
+// stopRunning stops a block left running in s, once the blocks that
+// follow it are done, by killing the shell's processes.  Unless it
+// finished by itself, the block passes, with the status the shell
+// exited with.  The shell's cleanup blocks still run.
+func (p *Program) stopRunning(s *session, b *runningBlock) *model.RunResult {
+	var result *model.BlockOutput
+	select {
+	case result = <-s.chAccOut:
+	default:
+		s.stopped = true
+		p.reap(s.pgid(), s.grace)
+		result = <-s.chAccOut
+		if result == nil || !result.Succeeded() {
+			output := ""
+			if result != nil {
+				output = s.sentinels.Strip(result.Output())
+			}
+			result = model.NewSuccessOutput(output).SetExitCode(s.exitStatus())
+		}
+	}
+	s.clearDetach()
+	r := p.blockResult(s, b.fileName, b.index, b.block, result, true)
+	return r.SetStart(b.start).SetDuration(time.Since(b.start))
+}
+
+// drain keeps the streams flowing once their output is no longer
+// wanted, so that the shell can't block on them.
+func drain(chOut <-chan scanner.Line, chAccErr <-chan *model.BlockOutput) {
+	go func() {
+		for range chOut {
+		}
+	}()
+	go func() {
+		for range chAccErr {
+		}
+	}()
+}
+
+// drainAll drains the streams of all the given shells.
+func drainAll(shells []*session) {
+	for _, s := range shells {
+		drain(s.chOut, s.chAccErr)
+	}
+}
+
+// blockTimeouts returns the time allowed for each block of the given
+// scripts to run, in order of execution, leaving out cleanup blocks,
+// which run apart from the others.  Blocks without a timeout
+// attribute get the program's default.
+func (p *Program) blockTimeouts(scripts []*model.Script) []time.Duration {
+	result := []time.Duration{}
+	for _, script := range scripts {
+		for _, block := range script.Blocks() {
+			if block.Cleanup() {
+				continue
+			}
+			t := block.Timeout()
+			if t == 0 {
+				t = p.blockTimeout
+			}
+			result = append(result, t)
+		}
+	}
+	return result
+}
+
+// numBlocks returns the number of blocks in the given scripts.
+func numBlocks(scripts []*model.Script) int {
+	n := 0
+	for _, script := range scripts {
+		n += len(script.Blocks())
+	}
+	return n
+}
+
+// fillErrResult fills an instance of RunResult from the given shell's
+// stderr and exit status, mapping diagnostics back to markdown lines.
+func fillErrResult(s *session, errResult *model.RunResult) {
+	result := <-s.chAccErr
 	if result == nil {
 		if glog.V(2) {
 			glog.Info("userBehavior: stderr Result == nil.")
@@ -272,7 +761,8 @@ func fillErrResult(chAccErr <-chan *model.BlockOutput, errResult *model.RunResul
 		errResult.SetProblem(errors.New("unknown"))
 		return
 	}
-	errResult.SetProblem(errors.New(result.Output())).SetMessage(result.Output())
+	message := s.smap.rewrite(s.sentinels.Strip(result.Output()))
+	errResult.SetProblem(errors.New(message)).SetMessage(message).SetExitCode(s.exitStatus())
 	if glog.V(2) {
 		glog.Info("userBehavior: stderr Result: %s", result.Output())
 	}
@@ -283,10 +773,13 @@ func fillErrResult(chAccErr <-chan *model.BlockOutput, errResult *model.RunResul
 // it will abort if any sub-subprocess (any command) fails.
 //
 // Command blocks are strings presumably holding code from some shell
-// language.  The strings may be more complex than single commands
-// delimitted by linefeeds - e.g. blocks that operate on HERE
-// documents, or multi-line commands using line continuation via '\',
-// quotes or curly brackets.
+// language.  Blocks naming another language with a known interpreter
+// (see SetInterpreters) are fed to that interpreter via a here
+// document, so they run as separate processes while the shell state
+// built by other blocks carries on.  The strings may be more complex
+// than single commands delimitted by linefeeds - e.g. blocks that
+// operate on HERE documents, or multi-line commands using line
+// continuation via '\', quotes or curly brackets.
 //
 // This function itself is not a shell interpreter, so it has no idea
 // if one line of text from a command block is an individual command
@@ -294,70 +787,268 @@ func fillErrResult(chAccErr <-chan *model.BlockOutput, errResult *model.RunResul
 //
 // Error reporting works by discarding output from command blocks that
 // succeeded, and only reporting the contents of stdout and stderr
-// when the subprocess exits on error.
+// when the subprocess exits on error.  Line numbers in shell
+// diagnostics are mapped back to the markdown the code came from.
+//
+// Normally all blocks run in one subprocess, which stops at the first
+// failure.  With SetKeepGoing, see shellRuns.  Either way, the result
+// returned is that of the first failure, if any.
 func (p *Program) RunInSubShell() (result *model.RunResult) {
-	// Write program to a file to be executed.
-	tmpFile, err := ioutil.TempFile("", "mdrip-script-")
-	check("create temp file", err)
-	check("chmod temp file", os.Chmod(tmpFile.Name(), 0744))
-	for _, script := range p.Scripts {
-		for _, block := range script.Blocks() {
-			write(tmpFile, block.Code().String())
-			write(tmpFile, "\n")
-			write(tmpFile, "echo "+scanner.MsgHappy+" "+block.Name().String()+"\n")
+	p.results = []*model.RunResult{}
+	p.reaped = nil
+	start := time.Now()
+	p.events.emit(Event{Action: ActionStart, Blocks: numBlocks(p.Scripts)})
+	if !p.keepGoing {
+		result, waitError := p.runInShell(p.Scripts)
+		p.emitEnd(waitError, time.Since(start))
+		return result
+	}
+	var firstError error
+	for _, scripts := range p.shellRuns() {
+		r, waitError := p.runInShell(scripts)
+		if result == nil || (result.Problem() == nil && r.Problem() != nil) {
+			result, firstError = r, waitError
 		}
 	}
-	if glog.V(2) {
-		glog.Info("RunInSubShell: running commands from %s", tmpFile.Name())
+	p.results = p.inScriptOrder(p.results)
+	p.emitEnd(firstError, time.Since(start))
+	if result == nil {
+		result = model.NewRunResult()
 	}
-	defer func() {
-		check("delete temp file", os.Remove(tmpFile.Name()))
-	}()
-
-	// Adding "-e" to force the subshell to die on any error.
-	shell := exec.Command("bash", "-e", tmpFile.Name())
+	return result
+}
 
-	stdIn, err := shell.StdinPipe()
-	check("in pipe", err)
-	check("close shell's stdin", stdIn.Close())
+// Reaped returns the processes that were still running, and so were
+// killed, when a block timed out or a subprocess ended, e.g. servers
+// started in the background.
+func (p *Program) Reaped() []util.Process {
+	return p.reaped
+}
 
-	stdOut, err := shell.StdoutPipe()
-	check("out pipe", err)
+// SetMaxOutput sets the most bytes of a block's stdout, and of its
+// stderr, to keep for reports, leaving out the middle of longer
+// output.  Zero means no limit.
+func (p *Program) SetMaxOutput(maxOutput int) *Program {
+	p.maxOutput = maxOutput
+	return p
+}
 
-	stdErr, err := shell.StderrPipe()
-	check("err pipe", err)
+// SetKeepGoing arranges for RunInSubShell to carry on past failures,
+// so as to report on as many blocks as possible.
+func (p *Program) SetKeepGoing(keepGoing bool) *Program {
+	p.keepGoing = keepGoing
+	return p
+}
 
-	err = shell.Start()
-	check("shell start", err)
+// shellRuns groups blocks by the subprocess they run in when carrying
+// on past failures.  Each file gets its own subprocess, so a failure
+// only skips the rest of its file, and each block with the
+// independent label gets a subprocess of its own, after those of the
+// file's other blocks.
+func (p *Program) shellRuns() [][]*model.Script {
+	result := [][]*model.Script{}
+	for _, script := range p.Scripts {
+		shared, independent := []*model.CommandBlock{}, [][]*model.Script{}
+		for _, block := range script.Blocks() {
+			if block.Independent() {
+				independent = append(independent, []*model.Script{
+					model.NewScript(script.FileName(), []*model.CommandBlock{block})})
+			} else {
+				shared = append(shared, block)
+			}
+		}
+		if len(shared) > 0 {
+			result = append(result, []*model.Script{model.NewScript(script.FileName(), shared)})
+		}
+		result = append(result, independent...)
+	}
+	return result
+}
 
-	pid := shell.Process.Pid
-	if glog.V(2) {
-		glog.Info("RunInSubShell: pid = %d", pid)
+// inScriptOrder returns the given results, which may come from runs
+// of parts of scripts, in the order of the blocks of p.Scripts, with
+// each result's index being that of its block in its script.
+func (p *Program) inScriptOrder(results []*model.RunResult) []*model.RunResult {
+	byBlock := map[*model.CommandBlock]*model.RunResult{}
+	for _, r := range results {
+		byBlock[r.Block()] = r
 	}
-	pgid, err := util.GetProcesssGroupId(pid)
-	if err == nil {
-		if glog.V(2) {
-			glog.Info("RunInSubShell:  pgid = %d", pgid)
+	ordered := []*model.RunResult{}
+	for _, script := range p.Scripts {
+		for i, block := range script.Blocks() {
+			if r, ok := byBlock[block]; ok {
+				ordered = append(ordered, r.SetIndex(i))
+			}
 		}
 	}
+	return ordered
+}
 
-	result = p.userBehavior(stdOut, stdErr)
+// runInShell runs the blocks of the given scripts, each in the shell
+// it names (see startShells), returning the result of the first
+// failing block (or of the shells if no block failed), along with the
+// exit error of the failing block's shell, or else of the first shell
+// to fail.
+func (p *Program) runInShell(scripts []*model.Script) (*model.RunResult, error) {
+	shells := p.startShells(scripts)
+	defer func() {
+		for _, s := range shells {
+			s.remove()
+		}
+	}()
+	stopInterrupts := killOnInterrupt(maxGrace(shells), pgids(shells)...)
+	defer stopInterrupts()
+
+	result := p.userBehavior(scripts, shells)
+	failing := shellFor(shells, result.Block())
+	timedOut := result.Problem() != nil && result.Problem().Error() == scanner.MsgTimeout
+	if timedOut && failing != nil {
+		// Else the shell would carry on with the timed out block.
+		if killed := p.reap(failing.pgid(), failing.grace); len(killed) > 0 {
+			result.SetOutput(result.Output() + "Killed:\n" + processList(killed))
+		}
+	}
+	if _, ok := result.Problem().(*model.MismatchError); ok && failing != nil {
+		// Else the shell would carry on with the blocks that follow.
+		p.reap(failing.pgid(), failing.grace)
+	}
+	// Shells waiting for a turn that won't come can quit.
+	for _, s := range shells {
+		s.closeGate()
+	}
 
 	if glog.V(2) {
-		glog.Info("RunInSubShell:  Waiting for shell to end.")
+		glog.Info("RunInSubShell:  Waiting for shells to end.")
+	}
+	var waitError error
+	for _, s := range shells {
+		err := s.wait(p)
+		if err != nil {
+			glog.Warningf("Shell %q: %v", s.name, err)
+		}
+		if s == failing || (failing == nil && waitError == nil && !s.stopped) {
+			waitError = err
+		}
 	}
-	waitError := shell.Wait()
 	if result.Problem() == nil {
 		result.SetProblem(waitError)
 	}
+	if result.ExitCode() == model.UnknownExitCode && !timedOut {
+		// E.g. the block exited the shell with status zero.
+		result.SetExitCode(exitCode(waitError))
+	}
 	if glog.V(2) {
-		glog.Info("RunInSubShell:  Shell done.")
+		glog.Info("RunInSubShell:  Shells done.")
 	}
 
-	// killProcesssGroup(pgid)
-	return
+	// Cleanup failures don't hide the failure that stopped the run,
+	// but fail a run that would otherwise pass.
+	for _, s := range shells {
+		for _, r := range s.cleanupResults(scripts, p.maxOutput) {
+			p.results = append(p.results, r)
+			p.events.emit(blockEvent(ActionRun, r.FileName(), r.Block()))
+			p.events.emit(resultEvent(r))
+			if result.Problem() == nil && r.Problem() != nil {
+				result = r
+			}
+		}
+	}
+
+	// Processes started in the background may outlive the shells.
+	for _, s := range shells {
+		p.reap(s.pgid(), killGrace)
+	}
+	return result, waitError
+}
+
+// killGrace is how long processes have to exit after TERM before
+// they're sent KILL.
+const killGrace = 2 * time.Second
+
+// reap kills the processes in the given group, other than the shell
+// leading it, recording them in p.reaped.  They have the given grace
+// period to exit after TERM, e.g. for the shell to run cleanup blocks.
+func (p *Program) reap(pgid int, grace time.Duration) []util.Process {
+	killed := []util.Process{}
+	for _, proc := range util.KillProcessGroup(pgid, grace) {
+		if proc.Pid != pgid {
+			killed = append(killed, proc)
+		}
+	}
+	if len(killed) > 0 {
+		glog.Warningf("Killed leftover processes:\n%s", processList(killed))
+	}
+	p.reaped = append(p.reaped, killed...)
+	return killed
+}
+
+func processList(procs []util.Process) string {
+	var b bytes.Buffer
+	for _, proc := range procs {
+		b.WriteString("  " + proc.String() + "\n")
+	}
+	return b.String()
+}
+
+// killOnInterrupt arranges for the given process groups to be killed
+// if mdrip is interrupted, since, leading their own groups, shells
+// won't see a Ctrl-C from the terminal.  They have the given grace
+// period to exit after TERM.  Call the returned function to undo.
+func killOnInterrupt(grace time.Duration, pgids ...int) func() {
+	interrupts := make(chan os.Signal, 1)
+	done := make(chan bool)
+	signal.Notify(interrupts, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		select {
+		case sig := <-interrupts:
+			var wg sync.WaitGroup
+			for _, pgid := range pgids {
+				wg.Add(1)
+				go func(pgid int) {
+					defer wg.Done()
+					util.KillProcessGroup(pgid, grace)
+				}(pgid)
+			}
+			wg.Wait()
+			fmt.Fprintf(os.Stderr, "mdrip: %v\n", sig)
+			os.Exit(1)
+		case <-done:
+		}
+	}()
+	return func() {
+		signal.Stop(interrupts)
+		close(done)
+	}
+}
+
+// emitEnd emits the event for the run's end.
+func (p *Program) emitEnd(waitError error, elapsed time.Duration) {
+	if p.events == nil {
+		return
+	}
+	code := exitCode(waitError)
+	seconds := elapsed.Seconds()
+	e := Event{Action: ActionEnd, Elapsed: &seconds, ExitCode: &code}
+	if waitError != nil {
+		e.Message = waitError.Error()
+	}
+	p.events.emit(e)
 }
 
+// errTrap makes the shell report the script line and text of the
+// command that caused it to exit.  With errtrace (set -E), the trap
+// is inherited by functions and subshells, so that a command failing
+// in one is reported, rather than the call or subshell as a whole.
+const errTrap = `set -E; trap 'echo "$0: line $LINENO: failed command: $BASH_COMMAND" >&2' ERR`
+
+// exitTrap makes the shell report the exit status of the block that
+// ended it, which may differ from the shell's own, e.g. when the shell
+// is killed, on statusFd (see session.exitStatus), then run the
+// shell's cleanup blocks, if any.  The trap isn't inherited by
+// subshells.
+var exitTrap = fmt.Sprintf(`trap 'mdrip_status=$?; echo $mdrip_status >&%d; `+
+	`! declare -F %s >/dev/null || %s' EXIT`, statusFd, cleanupFunc, cleanupFunc)
+
 func write(writer io.Writer, output string) {
 	n, err := writer.Write([]byte(output))
 	if err != nil {
@@ -439,6 +1130,19 @@ div.commandBlock {
   width: 5px;
 }
 
+.location {
+  font-family: "Lucida Console", Monaco, monospace;
+  font-size: 0.6em;
+  font-weight: normal;
+  font-style: normal;
+  color: gray;
+}
+
+pre.problems {
+  color: darkred;
+  font-weight: bold;
+}
+
 pre.codeblock {
   font-family: "Lucida Console", Monaco, monospace;
   font-size: 0.8em;
@@ -526,6 +1230,12 @@ pre.codeblock {
 </head>
 `
 
+// shellWriter is an executor that can run code in named shells (see
+// model.AttrShell), e.g. in separate tmux panes.
+type shellWriter interface {
+	WriteToShell(shell string, code []byte) (int, error)
+}
+
 func (p *Program) makeBlockRunner(executor io.Writer) func(w http.ResponseWriter, r *http.Request) {
 	return func(w http.ResponseWriter, r *http.Request) {
 		// TODO(jregan): 404 on bad params
@@ -534,7 +1244,12 @@ func (p *Program) makeBlockRunner(executor io.Writer) func(w http.ResponseWriter
 		block := p.Scripts[indexScript].Blocks()[indexBlock]
 
 		glog.Info("Running ", block.Name())
-		_, err := executor.Write(block.Code().Bytes())
+		var err error
+		if sw, ok := executor.(shellWriter); ok && block.Shell() != "" {
+			_, err = sw.WriteToShell(block.Shell(), block.Code().Bytes())
+		} else {
+			_, err = executor.Write(block.Code().Bytes())
+		}
 
 		if err != nil {
 			fmt.Fprintln(w, err)
@@ -545,8 +1260,13 @@ func (p *Program) makeBlockRunner(executor io.Writer) func(w http.ResponseWriter
 }
 
 func (p *Program) showControlPage(w http.ResponseWriter, r *http.Request) {
-	p.Reload()
+	problems := p.Reload()
 	fmt.Fprintln(w, `<html>`+headerHtml+`<body onload="onLoad()">`)
+	if problems != nil {
+		glog.Warning(problems)
+		fmt.Fprintf(w, "<pre class=\"problems\">%s</pre>\n",
+			template.HTMLEscapeString(problems.Error()))
+	}
 	if err := templates.ExecuteTemplate(w, tmplNameProgram, p); err != nil {
 		glog.Fatal(err)
 	}
@@ -1,7 +1,15 @@
 package program
 
 import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"syscall"
 	"testing"
 	"time"
 
@@ -95,3 +103,989 @@ func TestTimeOut(t *testing.T) {
 		model.NewCommandBlock(labels, "echo beans\necho cheese\n")}
 	checkFail(t, doIt(blocks), want)
 }
+
+func TestErrorLinesMappedToMarkdown(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "echo tofu\ndate\n").SetSource("foo.md", 10, 11),
+		model.NewCommandBlock(labels, "echo beans\nlochNessMonster --big\necho kale\n").SetSource("foo.md", 20, 22)}
+	result := doIt(blocks)
+	if result.Problem() == nil {
+		t.Fatal("expected failure")
+	}
+	for _, want := range []string{
+		"foo.md:21: lochNessMonster: command not found",
+		"foo.md:21: failed command: lochNessMonster --big"} {
+		if !strings.Contains(result.Message(), want) {
+			t.Errorf("got\n\t%v\nwant it to contain\n\t%v", result.Message(), want)
+		}
+	}
+}
+
+func TestErrorLinesInFunctionsAndRetries(t *testing.T) {
+	tests := []struct {
+		name  string
+		block *model.CommandBlock
+		want  string
+	}{
+		{"function", model.NewCommandBlock(labels, "f() {\n  echo in f\n  false\n}\nf\n"),
+			"foo.md:12: failed command: false"},
+		{"subshell", model.NewCommandBlock(labels, "(\n  echo in subshell\n  false\n)\n"),
+			"foo.md:12: failed command: false"},
+		{"retry", model.NewCommandBlock(labels, "echo trying\nfalse\n").
+			SetAttribute(model.AttrRetry, "1"),
+			"foo.md:11: failed command: false"},
+		{"dir", model.NewCommandBlock(labels, "echo here\nfalse\n").
+			SetAttribute(model.AttrDir, os.TempDir()),
+			"foo.md:11: failed command: false"},
+		{"missingDir", model.NewCommandBlock(labels, "echo here\n").
+			SetAttribute(model.AttrDir, "/mdrip/no/such/dir"),
+			"foo.md:10: failed command: pushd"},
+	}
+	for _, test := range tests {
+		result := doIt([]*model.CommandBlock{test.block.SetSource("foo.md", 10, 14)})
+		if result.Problem() == nil {
+			t.Errorf("%s: expected failure", test.name)
+			continue
+		}
+		if !strings.Contains(result.Message(), test.want) {
+			t.Errorf("%s: got\n\t%v\nwant it to contain\n\t%v", test.name, result.Message(), test.want)
+		}
+		if strings.Contains(result.Message(), "mdrip-script-") {
+			t.Errorf("%s: unmapped line in\n\t%v", test.name, result.Message())
+		}
+	}
+}
+
+func TestInterpretedBlocks(t *testing.T) {
+	if _, err := exec.LookPath("perl"); err != nil {
+		t.Skip("skipping test since perl not found")
+	}
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "export GREETING=hello\n"),
+		model.NewCommandBlock(labels, "print \"$ENV{GREETING}\\n\";\n").SetLanguage("perl"),
+		model.NewCommandBlock(labels, "die \"no kale\\n\";\n").SetLanguage("perl"),
+		model.NewCommandBlock(labels, "echo beans\n")}
+	want := model.NoCommandsRunResult(
+		model.NewFailureOutput("dunno"), "iAmFileName", 2, "no kale")
+	checkFail(t, doIt(blocks), want)
+}
+
+func TestHereDocumentDelimiter(t *testing.T) {
+	code := "one\nMDRIP_EOF\nMDRIP_EOF_0\ntwo\n"
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, code).SetLanguage("text")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		SetInterpreters(map[string]string{"text": "cat"}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	if out := p.Results()[0].Output(); !strings.HasPrefix(out, code) {
+		t.Errorf("got %q, want the whole block, %q", out, code)
+	}
+}
+
+func TestBlockTimeoutAttribute(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "sleep "+(timeout+time.Second).String()+"\n").
+			SetAttribute(model.AttrTimeout, (timeout + 3*time.Second).String()),
+		model.NewCommandBlock(labels, "sleep "+timeout.String()+"\n").
+			SetAttribute(model.AttrTimeout, "1s")}
+	want := model.NoCommandsRunResult(
+		model.NewFailureOutput("dunno"), "iAmFileName", 1, scanner.MsgTimeout)
+	checkFail(t, doIt(blocks), want)
+}
+
+func TestRetryAndDirAttributes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := []*model.CommandBlock{
+		// Fails until its second retry.
+		model.NewCommandBlock(labels, "echo x >>tries\n[ $(wc -l <tries) -ge 3 ]\n").
+			SetAttribute(model.AttrRetry, "2").SetAttribute(model.AttrDir, dir),
+		model.NewCommandBlock(labels, "[ ! -e tries ]\n")}
+	if result := doIt(blocks); result.Problem() != nil {
+		t.Errorf("unexpected failure: %v", result.Problem())
+	}
+}
+
+func TestDirAttributeQuoted(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	odd := dir + "/it's a $(touch injected) dir"
+	if err := os.Mkdir(odd, 0755); err != nil {
+		t.Fatal(err)
+	}
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "pwd\n").SetAttribute(model.AttrDir, odd)}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	if out := p.Results()[0].Output(); out != odd+"\n" {
+		t.Errorf("got %q, want %q", out, odd+"\n")
+	}
+	if _, err := os.Stat("injected"); err == nil {
+		os.Remove("injected")
+		t.Errorf("the directory name ran as code")
+	}
+}
+
+func TestLanguageFilter(t *testing.T) {
+	f, err := ioutil.TempFile("", "mdrip-lang-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<!-- @foo -->\n```yaml\nkind: Pod\n```\n" +
+		"<!-- @foo -->\n```json\n{}\n```\n" +
+		"<!-- @foo -->\n```\necho plain\n```\n" +
+		"<!-- @foo -->\n```bash\necho bash\n```\n" +
+		"<!-- @foo -->\n```sh\necho sh\n```\n")
+	f.Close()
+	for _, c := range []struct {
+		languages []string
+		want      string
+	}{
+		{nil, "yaml json  bash sh"},
+		{[]string{"bash", "sh"}, " bash sh"},
+		{[]string{"yaml"}, "yaml "},
+	} {
+		p := NewProgram(timeout, "foo", []model.FileName{model.FileName(f.Name())}).
+			SetLanguages(c.languages)
+		if err := p.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		got := []string{}
+		for _, script := range p.Scripts {
+			for _, b := range script.Blocks() {
+				got = append(got, b.Language())
+			}
+		}
+		if strings.Join(got, " ") != c.want {
+			t.Errorf("--lang %v: got languages %q, want %q", c.languages, got, c.want)
+		}
+	}
+}
+
+func TestReloadUnreadable(t *testing.T) {
+	f, err := ioutil.TempFile("", "mdrip-reload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<!-- @foo -->\n```\necho kale\n```\n")
+	f.Close()
+	missing := model.FileName(f.Name() + "-missing")
+	p := NewProgram(timeout, labels[0], []model.FileName{missing, model.FileName(f.Name())})
+	err = p.Reload()
+	if err == nil || !strings.Contains(err.Error(), "Unable to read "+string(missing)) {
+		t.Errorf("expected an error for the missing file, got %v", err)
+	}
+	if p.ScriptCount() != 1 || p.Scripts[0].FileName() != model.FileName(f.Name()) {
+		t.Errorf("expected one script from the readable file, got %v", p.Scripts)
+	}
+}
+
+func TestReloadMalformedOnly(t *testing.T) {
+	f, err := ioutil.TempFile("", "mdrip-reload-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<!-- @foo oops -->\n```\necho kale\n```\n")
+	f.Close()
+	// Reload mustn't exit, so that the problem can be reported cleanly.
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{model.FileName(f.Name())})
+	err = p.Reload()
+	want := f.Name() + ":1:11: improperly closed block label sequence"
+	if err == nil || err.Error() != want {
+		t.Errorf("got %v, want %s", err, want)
+	}
+	if p.ScriptCount() != 0 {
+		t.Errorf("expected no scripts, got %v", p.Scripts)
+	}
+}
+
+func TestReloadFromStdin(t *testing.T) {
+	f, err := ioutil.TempFile("", "mdrip-stdin-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	f.WriteString("<!-- @foo -->\n```\necho kale\n```\n")
+	f.Seek(0, 0)
+	saved := os.Stdin
+	os.Stdin = f
+	defer func() { os.Stdin = saved }()
+
+	p := NewProgram(timeout, labels[0], []model.FileName{"-"})
+	// Reloading must not need to read stdin again.
+	for i := 0; i < 2; i++ {
+		if err := p.Reload(); err != nil {
+			t.Fatal(err)
+		}
+		if p.ScriptCount() != 1 || p.Scripts[0].FileName() != "<stdin>" {
+			t.Fatalf("expected one script from <stdin>, got %v", p.Scripts)
+		}
+	}
+}
+
+func TestEventStream(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock([]model.Label{"kale"}, "echo kale\n").SetLanguage("bash"),
+		model.NewCommandBlock([]model.Label{"oops"}, "echo oops >&2\nexit 3\n"),
+		model.NewCommandBlock([]model.Label{"never"}, "echo never\n")}
+	var buf bytes.Buffer
+	NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks)).
+		SetEventStream(&buf).RunInSubShell()
+
+	// Output events race with the others, so are checked separately.
+	actions, outputs := []string{}, []string{}
+	var fail, end Event
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event %q: %v", line, err)
+		}
+		switch e.Action {
+		case ActionOutput:
+			outputs = append(outputs, e.Block+":"+e.Stream+":"+e.Output)
+			continue
+		case ActionFail:
+			fail = e
+		case ActionEnd:
+			end = e
+		}
+		actions = append(actions, e.Action+":"+e.Block)
+		if e.Block == "kale" && e.Language != "bash" {
+			t.Errorf("expected the language on %s events, got %q", e.Action, e.Language)
+		}
+	}
+	want := []string{
+		"start:", "run:kale", "pass:kale", "run:oops", "fail:oops", "skip:never", "end:"}
+	if strings.Join(actions, " ") != strings.Join(want, " ") {
+		t.Errorf("got events\n\t%v\nwant\n\t%v", actions, want)
+	}
+	want = []string{"kale:stdout:kale", "oops:stderr:oops"}
+	if strings.Join(outputs, " ") != strings.Join(want, " ") {
+		t.Errorf("got output events\n\t%v\nwant\n\t%v", outputs, want)
+	}
+	if fail.ExitCode == nil || *fail.ExitCode != 3 || fail.Elapsed == nil {
+		t.Errorf("bad fail event: %+v", fail)
+	}
+	if end.ExitCode == nil || *end.ExitCode != 3 {
+		t.Errorf("bad end event: %+v", end)
+	}
+}
+
+func TestFailEventBeforeShellExits(t *testing.T) {
+	var buf bytes.Buffer
+	NewProgram(300*time.Millisecond, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", []*model.CommandBlock{
+			model.NewCommandBlock(labels, "trap '' TERM\nsleep 10\n"),
+			model.NewCommandBlock(labels, "echo never\n")})).
+		SetEventStream(&buf).RunInSubShell()
+
+	// Ignoring TERM, the timed out block is only killed after a grace
+	// period.
+	times := map[string]time.Time{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		var e Event
+		if err := json.Unmarshal([]byte(line), &e); err != nil {
+			t.Fatalf("bad event %q: %v", line, err)
+		}
+		times[e.Action] = e.Time
+	}
+	for _, action := range []string{ActionFail, ActionSkip} {
+		if d := times[ActionEnd].Sub(times[action]); d < 500*time.Millisecond {
+			t.Errorf("%s event only %v before the end", action, d)
+		}
+	}
+}
+
+func TestKeepGoing(t *testing.T) {
+	independent := []model.Label{"check", model.IndependentLabel}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("first.md", []*model.CommandBlock{
+			model.NewCommandBlock(labels, "x=1\n"),
+			model.NewCommandBlock(labels, "false\n"),
+			model.NewCommandBlock(independent, "[ -z \"$x\" ]\n"),
+			model.NewCommandBlock(labels, "echo skipped\n")})).
+		Add(model.NewScript("second.md", []*model.CommandBlock{
+			model.NewCommandBlock(labels, "echo fine\n"),
+			model.NewCommandBlock(labels, "exit 4\n")})).
+		SetKeepGoing(true)
+	result := p.RunInSubShell()
+	if result.Problem() == nil || result.FileName() != "first.md" || result.Index() != 1 {
+		t.Errorf("expected first failure in first.md, got %s %d %v",
+			result.FileName(), result.Index(), result.Problem())
+	}
+	got := []string{}
+	for _, r := range p.Results() {
+		status := "pass"
+		switch {
+		case r.Skipped():
+			status = "skip"
+		case r.Problem() != nil:
+			status = "fail"
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%s", r.FileName(), r.Index(), status))
+	}
+	want := []string{
+		"first.md:0:pass", "first.md:1:fail", "first.md:2:pass", "first.md:3:skip",
+		"second.md:0:pass", "second.md:1:fail"}
+	if strings.Join(got, " ") != strings.Join(want, " ") {
+		t.Errorf("got results\n\t%v\nwant\n\t%v", got, want)
+	}
+}
+
+func TestLeftoverProcessesKilled(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// The process is identified by its pid, since it may be reaped
+	// before it has become a sleep.
+	pidFile := dir + "/pid"
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "sleep 301 &\necho $! >"+pidFile+"\n"),
+		model.NewCommandBlock(labels, "echo done\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	contents, err := ioutil.ReadFile(pidFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	pid := strings.TrimSpace(string(contents))
+	if len(p.Reaped()) != 1 || fmt.Sprint(p.Reaped()[0].Pid) != pid {
+		t.Fatalf("expected the background sleep, pid %s, to be reaped, got %v", pid, p.Reaped())
+	}
+	// Give init a moment to reap it.
+	for start := time.Now(); syscall.Kill(p.Reaped()[0].Pid, 0) == nil; {
+		if time.Since(start) > killGrace {
+			t.Fatalf("background sleep still running")
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+}
+
+func TestTimedOutBlockKilled(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "sleep 302\n").
+			SetAttribute(model.AttrTimeout, "500ms")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	start := time.Now()
+	result := p.RunInSubShell()
+	if result.Problem() == nil || !strings.Contains(result.Output(), "sleep 302") {
+		t.Errorf("expected a timeout naming the killed sleep, got %v\n%s",
+			result.Problem(), result.Output())
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("run outlived its timed out block, taking %v", elapsed)
+	}
+}
+
+func TestExitCodes(t *testing.T) {
+	if _, err := exec.LookPath("python3"); err != nil {
+		t.Skip("skipping test since python3 not found")
+	}
+	for code, want := range map[string]int{
+		"notagoodcommand\n":      127,
+		"exit 3\n":               3,
+		"echo x | grep -q y\n":   1,
+		"python3 -c 'exit(5)'\n": 5,
+	} {
+		p := NewProgram(timeout, labels[0], []model.FileName{}).
+			Add(model.NewScript("iAmFileName", []*model.CommandBlock{
+				model.NewCommandBlock(labels, "echo fine\n"),
+				model.NewCommandBlock(labels, code)}))
+		result := p.RunInSubShell()
+		if result.ExitCode() != want || result.Start().IsZero() {
+			t.Errorf("%q: got exit code %d, start %v", code, result.ExitCode(), result.Start())
+		}
+		if first := p.Results()[0]; first.ExitCode() != 0 || first.Duration() <= 0 {
+			t.Errorf("%q: bad result for passing block, %s", code, first.Status())
+		}
+	}
+}
+
+func TestPassingExitCodes(t *testing.T) {
+	// A shell running with -e carries on past a failing command that
+	// isn't the last in a list, so a block can finish with any status.
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "echo fine\n"),
+		model.NewCommandBlock(labels, "test -e /mdrip/nope && rm /mdrip/nope\n"),
+		model.NewCommandBlock(labels, "true\n"),
+		model.NewCommandBlock(labels, "echo here\ntest -e /mdrip/nope && rm /mdrip/nope\n").
+			SetAttribute(model.AttrDir, os.TempDir())}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	for i, want := range []int{0, 1, 0, 1} {
+		if got := p.Results()[i].ExitCode(); got != want {
+			t.Errorf("block %d: got exit code %d, want %d", i, got, want)
+		}
+	}
+}
+
+func TestSpoofedSentinels(t *testing.T) {
+	// Output that looks like mdrip's own, e.g. from catting its source,
+	// mustn't end the block or change its status.
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "echo "+scanner.MsgHappy+" fake\n"+
+			"echo "+scanner.MsgTimeout+"\nexit 3\n"),
+		model.NewCommandBlock(labels, "echo never\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if result.Block() != blocks[0] || result.ExitCode() != 3 {
+		t.Errorf("expected the first block to fail with status 3, got %d in %v",
+			result.ExitCode(), result.Block())
+	}
+	if !strings.Contains(result.Output(), scanner.MsgHappy+" fake") {
+		t.Errorf("expected the fake sentinel in the output, got %q", result.Output())
+	}
+	if !p.Results()[1].Skipped() {
+		t.Errorf("expected the second block to be skipped")
+	}
+
+	// Nor can a block print the sentinels by catting its script, or by
+	// tracing the commands that print them.
+	blocks = []*model.CommandBlock{
+		model.NewCommandBlock(labels, "cat \"$0\"; set -xv\n"),
+		model.NewCommandBlock(labels, "printf 'no line end'\n"),
+		model.NewCommandBlock(labels, "set +xv; echo last\n")}
+	p = NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("expected success, got %v", result.Problem())
+	}
+	if !strings.Contains(p.Results()[0].Output(), scanner.MsgHappy) {
+		t.Errorf("expected the script in the output, got %q", p.Results()[0].Output())
+	}
+	if out := p.Results()[1].Output(); out != "no line end" {
+		t.Errorf("expected output without a line end, got %q", out)
+	}
+	if out := p.Results()[2].Output(); out != "last\n" {
+		t.Errorf("expected the last block's output, got %q", out)
+	}
+
+	var out bytes.Buffer
+	p = NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if err := p.Step(strings.NewReader("r\nr\nr\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"no line end", "last\n(exit status 0)\n", "Ran 3 blocks"} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in\n%s", want, out.String())
+		}
+	}
+}
+
+func TestLongOutput(t *testing.T) {
+	long := "head -c 200000 /dev/zero | tr '\\0' x; echo\n"
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, long),
+		model.NewCommandBlock(labels, "printf 'bin\\xff\\xfe\\n'\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("expected success, got %v", result.Problem())
+	}
+	if out := p.Results()[0].Output(); out != strings.Repeat("x", 200000)+"\n" {
+		t.Errorf("expected the whole line, got %d bytes", len(out))
+	}
+	if out := p.Results()[1].Output(); out != "bin\uFFFD\n" {
+		t.Errorf("expected bytes that aren't UTF-8 replaced, got %q", out)
+	}
+
+	blocks = []*model.CommandBlock{
+		model.NewCommandBlock(labels, long+"echo last\nexit 4\n")}
+	p = NewProgram(timeout, labels[0], []model.FileName{}).
+		SetMaxOutput(1000).Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if result.ExitCode() != 4 {
+		t.Errorf("expected exit status 4, got %d", result.ExitCode())
+	}
+	out := result.Output()
+	if len(out) > 1100 || !strings.Contains(out, "mdrip omitted 199006 bytes") ||
+		!strings.HasSuffix(out, "last\n") {
+		t.Errorf("expected truncated output, got %d bytes:\n%s", len(out), out)
+	}
+
+	// Megabytes without a line end needn't be held in memory at once.
+	blocks = []*model.CommandBlock{
+		model.NewCommandBlock(labels, "head -c 8000000 /dev/zero | tr '\\0' x; echo\n")}
+	p = NewProgram(timeout, labels[0], []model.FileName{}).
+		SetMaxOutput(1000).Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("expected success, got %v", result.Problem())
+	}
+	if out := p.Results()[0].Output(); len(out) > 1100 ||
+		!strings.Contains(out, "mdrip omitted 7999001 bytes") {
+		t.Errorf("expected truncated output, got %d bytes:\n%s", len(out), out)
+	}
+}
+
+func TestExpectedOutput(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	marker := dir + "/ran"
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "echo kale\necho pid $$\n").
+			SetExpectation(model.NewExpectation("kale\npid [0-9]+ (re)\n")),
+		model.NewCommandBlock(labels, "echo beans\n").
+			SetExpectation(model.NewExpectation("peas\n")),
+		model.NewCommandBlock(labels, "touch "+marker+"\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if _, err := os.Stat(marker); err == nil {
+		t.Errorf("the block after the mismatch ran")
+	}
+	if _, ok := result.Problem().(*model.MismatchError); !ok || result.Index() != 1 {
+		t.Fatalf("expected mismatch in second block, got %d %v", result.Index(), result.Problem())
+	}
+	if !strings.Contains(result.Problem().Error(), "-peas\n+beans\n") {
+		t.Errorf("expected a diff, got %s", result.Problem())
+	}
+	if !p.Results()[2].Skipped() {
+		t.Errorf("expected the last block to be skipped")
+	}
+}
+
+func TestExpectedOutputTooLong(t *testing.T) {
+	for _, update := range []bool{false, true} {
+		blocks := []*model.CommandBlock{
+			model.NewCommandBlock(labels, "head -c 300 /dev/zero | tr '\\0' x; echo\n").
+				SetExpectation(model.NewExpectation("x\n").SetSource("foo.md", 5, 5))}
+		p := NewProgram(timeout, labels[0], []model.FileName{}).
+			SetMaxOutput(100).SetUpdate(update).Add(model.NewScript("iAmFileName", blocks))
+		result := p.RunInSubShell()
+		if result.Problem() == nil ||
+			!strings.Contains(result.Problem().Error(), "too long to check against foo.md:5") {
+			t.Errorf("update %v: expected the check to be refused, got %v", update, result.Problem())
+		}
+		if updated, err := p.UpdateExpectations(); err != nil || len(updated) != 0 {
+			t.Errorf("update %v: expected no update, got %v, %v", update, updated, err)
+		}
+	}
+}
+
+func TestUpdateExpectations(t *testing.T) {
+	f, err := ioutil.TempFile("", "mdrip-update-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(f.Name())
+	markdown := "Intro.\n\n" +
+		"<!-- @foo -->\n```\necho one; echo pid $$; echo two\n```\n\n" +
+		"<!-- @expect -->\n```\nuno\npid [0-9]+ (re)\ntwo\n```\n\n" +
+		" 1. In a list:\n\n" +
+		"    <!-- @foo -->\n    ```console\n    $ echo three\n    $ echo four\n    4\n    ```\n" +
+		"\nThe end.\n"
+	want := strings.Replace(strings.Replace(markdown,
+		"uno\n", "one\n", 1),
+		"    $ echo three\n    $ echo four\n    4\n",
+		"    $ echo three\n    three\n    $ echo four\n    four\n", 1)
+	if _, err := f.WriteString(markdown); err != nil {
+		t.Fatal(err)
+	}
+	f.Close()
+
+	p := NewProgram(timeout, labels[0], []model.FileName{model.FileName(f.Name())})
+	if err := p.Reload(); err != nil {
+		t.Fatal(err)
+	}
+	if result := p.SetUpdate(true).RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	updated, err := p.UpdateExpectations()
+	if err != nil || len(updated) != 1 {
+		t.Fatalf("expected one file updated, got %v %v", updated, err)
+	}
+	got, _ := ioutil.ReadFile(f.Name())
+	if string(got) != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestNamedShells(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-shells-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	in := func(shell, code string) *model.CommandBlock {
+		b := model.NewCommandBlock(labels, code)
+		if shell != "" {
+			b.SetAttribute(model.AttrShell, shell)
+		}
+		return b
+	}
+	blocks := []*model.CommandBlock{
+		in("server", "name=server; echo up > "+dir+"/flag\n"),
+		// The client has its own state, but sees what the server did.
+		in("client", "[ -z \"$name\" ]; cat "+dir+"/flag\n"),
+		// The server's clock doesn't run while it waits for its turn.
+		in("client", "sleep 3\n").SetAttribute(model.AttrTimeout, "5s"),
+		in("server", "[ \"$name\" = server ]\n"),
+		in("", "echo default\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	for i, r := range p.Results() {
+		if r.Block() != blocks[i] || r.Index() != i || r.Problem() != nil {
+			t.Errorf("result %d: got block %d, problem %v", i, r.Index(), r.Problem())
+		}
+	}
+	if out := p.Results()[1].Output(); out != "up\n" {
+		t.Errorf("client output %q", out)
+	}
+
+	blocks = []*model.CommandBlock{
+		in("server", "sleep 302 &\n"),
+		in("client", "false\n"),
+		in("server", "echo skipped\n")}
+	p = NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if result.Problem() == nil || result.Block() != blocks[1] || result.ExitCode() != 1 {
+		t.Errorf("expected the client to fail, got %v in %v", result.Problem(), result.Block())
+	}
+	if !p.Results()[2].Skipped() {
+		t.Errorf("expected the server's last block to be skipped")
+	}
+	if len(p.Reaped()) != 1 || !strings.Contains(p.Reaped()[0].Command, "sleep 302") {
+		t.Errorf("expected the server's background sleep to be reaped, got %v", p.Reaped())
+	}
+}
+
+func TestReadiness(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-ready-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "(sleep 0.5; touch "+dir+"/ready) &\n").
+			SetAttribute(model.AttrWaitFor, "file:"+dir+"/ready"),
+		model.NewCommandBlock(labels, "[ -e "+dir+"/ready ]\n"),
+		model.NewCommandBlock(labels, "(sleep 0.5; touch here) &\n").
+			SetAttribute(model.AttrDir, dir).SetAttribute(model.AttrWaitFor, "file:here"),
+		model.NewCommandBlock(labels, "(sleep 0.5; echo Listening on 80) &\n").
+			SetAttribute(model.AttrWaitFor, "stdout:/Listening on/"),
+		model.NewCommandBlock(labels, "echo next\n").
+			SetAttribute(model.AttrWaitFor, "file:"+dir+"/never").
+			SetAttribute(model.AttrWaitTimeout, "300ms"),
+		model.NewCommandBlock(labels, "echo skipped\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if _, ok := result.Problem().(*model.NotReadyError); !ok || result.Block() != blocks[4] {
+		t.Fatalf("expected block 4 never to be ready, got %v in %v", result.Problem(), result.Block())
+	}
+	if !strings.Contains(result.Problem().Error(), "readiness never reached: file:"+dir+"/never") {
+		t.Errorf("unexpected problem: %v", result.Problem())
+	}
+	for i, r := range p.Results()[:4] {
+		if r.Problem() != nil {
+			t.Errorf("block %d failed: %v", i, r.Problem())
+		}
+	}
+	if !p.Results()[5].Skipped() {
+		t.Errorf("expected the last block to be skipped")
+	}
+}
+
+func TestForegroundServer(t *testing.T) {
+	in := func(shell, code string) *model.CommandBlock {
+		return model.NewCommandBlock(labels, code).SetAttribute(model.AttrShell, shell)
+	}
+	server := func(code string) *model.CommandBlock {
+		// The server's clock stops once it's ready.
+		return in("server", code).
+			SetAttribute(model.AttrWaitFor, "stdout:/Listening/").
+			SetAttribute(model.AttrTimeout, "1s")
+	}
+	blocks := []*model.CommandBlock{
+		server("echo Listening\nsleep 303\n"),
+		in("client", "sleep 1.5; echo client\n")}
+	p := NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v", result.Problem())
+	}
+	if len(p.Results()) != 2 {
+		t.Fatalf("expected 2 results, got %d", len(p.Results()))
+	}
+	for i, r := range p.Results() {
+		if r.Block() != blocks[i] || r.Problem() != nil {
+			t.Errorf("result %d: got block %d, problem %v", i, r.Index(), r.Problem())
+		}
+	}
+	if out := p.Results()[0].Output(); out != "Listening\n" {
+		t.Errorf("server output %q", out)
+	}
+	if out := p.Results()[1].Output(); out != "client\n" {
+		t.Errorf("client output %q", out)
+	}
+	if len(p.Reaped()) != 1 || !strings.Contains(p.Reaped()[0].Command, "sleep 303") {
+		t.Errorf("expected the server to be stopped, got %v", p.Reaped())
+	}
+
+	// The server's shell can't run another block while the server runs.
+	blocks = []*model.CommandBlock{
+		server("echo Listening\nsleep 304\n"),
+		in("client", "true\n"),
+		in("server", "echo skipped\n")}
+	p = NewProgram(timeout, labels[0], []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if result.Problem() == nil || result.Problem().Error() != scanner.MsgTimeout ||
+		result.Block() != blocks[0] {
+		t.Errorf("expected the server to time out, got %v in %v", result.Problem(), result.Block())
+	}
+	if p.Results()[1].Problem() != nil || !p.Results()[2].Skipped() {
+		t.Errorf("expected the client to pass and the last block to be skipped")
+	}
+}
+
+func TestCleanup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-cleanup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cleanup := []model.Label{"tidy", model.CleanupLabel}
+	for _, c := range []struct {
+		name    string
+		blocks  []*model.CommandBlock
+		failure int    // Index of the failing block, or -1.
+		want    string // What the cleanup block wrote.
+	}{
+		{"pass", []*model.CommandBlock{
+			model.NewCommandBlock(labels, "x=1\n"),
+			model.NewCommandBlock(cleanup, "echo $x >"+dir+"/pass\n"),
+			model.NewCommandBlock(labels, "x=2\n")}, -1, "2\n"},
+		{"fail", []*model.CommandBlock{
+			model.NewCommandBlock(cleanup, "echo $x >"+dir+"/fail\n"),
+			model.NewCommandBlock(labels, "x=1\n"),
+			model.NewCommandBlock(labels, "false\n"),
+			model.NewCommandBlock(labels, "x=2\n")}, 2, "1\n"},
+		{"timeout", []*model.CommandBlock{
+			model.NewCommandBlock(labels, "x=1\n"),
+			model.NewCommandBlock(labels, "sleep 303\n").SetAttribute(model.AttrTimeout, "500ms"),
+			model.NewCommandBlock(cleanup, "echo $x >"+dir+"/timeout\n")}, 1, "1\n"},
+	} {
+		p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+			Add(model.NewScript("iAmFileName", c.blocks))
+		result := p.RunInSubShell()
+		if c.failure < 0 && result.Problem() != nil {
+			t.Errorf("%s: unexpected failure: %v", c.name, result.Problem())
+		}
+		if c.failure >= 0 && (result.Problem() == nil || result.Index() != c.failure) {
+			t.Errorf("%s: expected block %d to fail, got %d %v",
+				c.name, c.failure, result.Index(), result.Problem())
+		}
+		if got, _ := ioutil.ReadFile(dir + "/" + c.name); string(got) != c.want {
+			t.Errorf("%s: cleanup wrote %q, want %q", c.name, got, c.want)
+		}
+		last := p.Results()[len(p.Results())-1]
+		if !last.Block().Cleanup() || !last.Succeeded() || last.ExitCode() != 0 {
+			t.Errorf("%s: expected the cleanup block's result last, got %v", c.name, last.Block())
+		}
+	}
+
+	// A failing cleanup block fails the run, without stopping the
+	// cleanup blocks that follow it.
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "echo fine\n"),
+		model.NewCommandBlock(cleanup, "false\necho bye; sh -c 'exit 3'\n"),
+		model.NewCommandBlock(cleanup, "touch "+dir+"/after\n")}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if result.Block() != blocks[1] || result.ExitCode() != 3 || !strings.Contains(result.Output(), "bye\n") {
+		t.Errorf("expected the cleanup block to fail, got %v in %v", result.Problem(), result.Block())
+	}
+	if _, err := os.Stat(dir + "/after"); err != nil {
+		t.Errorf("second cleanup block didn't run: %v", err)
+	}
+	if len(p.Results()) != 3 || p.Results()[2].Problem() != nil {
+		t.Errorf("expected three results, the last passing")
+	}
+}
+
+func TestCleanupSharesJobs(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "sleep 301 &\n"),
+		model.NewCommandBlock([]model.Label{"stop", model.CleanupLabel}, "kill %1\nwait %1 || echo $?\n"),
+		model.NewCommandBlock(labels, "echo fine\n")}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	if result := p.RunInSubShell(); result.Problem() != nil {
+		t.Fatalf("unexpected failure: %v\n%s", result.Problem(), result.Output())
+	}
+	last := p.Results()[len(p.Results())-1]
+	// The job was killed by TERM.
+	if last.Block() != blocks[1] || last.ExitCode() != 0 || last.Output() != "143\n" {
+		t.Errorf("expected the cleanup block to kill the job, got %d: %q", last.ExitCode(), last.Output())
+	}
+}
+
+func TestCleanupRetried(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-cleanup-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	cleanup := []model.Label{"tidy", model.CleanupLabel}
+	// A retried cleanup block that never works mustn't end the cleanup.
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "echo fine\n"),
+		model.NewCommandBlock(cleanup, "sh -c 'exit 4'\n").SetAttribute(model.AttrRetry, "1"),
+		model.NewCommandBlock(cleanup, "touch "+dir+"/after\n")}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	result := p.RunInSubShell()
+	if result.Block() != blocks[1] || result.ExitCode() != 4 {
+		t.Errorf("expected the retried cleanup block to fail, got %v in %v", result.Problem(), result.Block())
+	}
+	if _, err := os.Stat(dir + "/after"); err != nil {
+		t.Errorf("second cleanup block didn't run: %v", err)
+	}
+}
+
+func TestStep(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock([]model.Label{"setX"}, "x=kale\n"),
+		model.NewCommandBlock([]model.Label{"skipMe"}, "x=beans\n"),
+		model.NewCommandBlock([]model.Label{"edit"}, "echo one $x\n"),
+		model.NewCommandBlock([]model.Label{"fail"}, "echo oops >&2; false\n"),
+		model.NewCommandBlock([]model.Label{"never"}, "echo never\n")}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	os.Setenv("EDITOR", "sed -i s/one/two/")
+	defer os.Unsetenv("EDITOR")
+	var out bytes.Buffer
+	if err := p.Step(strings.NewReader("r\ns\ne\nr\nbogus\n\nq\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		"@setX (block 1 of 5)",
+		"echo two $x\n",
+		"two kale\n(exit status 0)\n",
+		"Please answer r, s, e or q.",
+		"oops\n(exit status 1)\n",
+		"Ran 3 blocks, skipped 1, of 5.\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in\n%s", want, out.String())
+		}
+	}
+	if strings.Contains(out.String(), "never\n(exit") {
+		t.Errorf("ran a block after quitting")
+	}
+}
+
+func TestStepLongOutput(t *testing.T) {
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock(labels, "head -c 100000 /dev/zero | tr '\\0' x\n")}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	var out bytes.Buffer
+	if err := p.Step(strings.NewReader("r\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	if want := strings.Repeat("x", 100000) + "(exit status 0)\n"; !strings.Contains(out.String(), want) {
+		t.Errorf("expected the whole line then the status, got %d bytes", out.Len())
+	}
+}
+
+func TestStepInput(t *testing.T) {
+	defer func(name string) { ttyName = name }(ttyName)
+	ttyName = filepath.Join(os.TempDir(), "mdrip-no-such-tty")
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{"a.md"})
+	if in, err := p.StepInput(); err != nil || in != os.Stdin {
+		t.Errorf("expected stdin for answers, got %v, %v", in, err)
+	}
+	// Stdin holds the markdown, so can't hold answers too.
+	p = NewProgram(timeout, model.AnyLabel, []model.FileName{"a.md", stdinArg})
+	if _, err := p.StepInput(); err == nil {
+		t.Errorf("expected an error with no terminal to read answers from")
+	}
+	tty, err := ioutil.TempFile("", "mdrip-tty-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove(tty.Name())
+	tty.Close()
+	ttyName = tty.Name()
+	in, err := p.StepInput()
+	if err != nil || in.Name() != tty.Name() {
+		t.Errorf("expected answers from %s, got %v, %v", tty.Name(), in, err)
+	}
+	if in != nil {
+		in.Close()
+	}
+}
+
+func TestStepDirAndExit(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-test-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	blocks := []*model.CommandBlock{
+		model.NewCommandBlock([]model.Label{"there"}, "pwd; false\n").SetAttribute(model.AttrDir, dir),
+		model.NewCommandBlock([]model.Label{"back"}, "pwd\n"),
+		model.NewCommandBlock([]model.Label{"quit"}, "x=lost; exit 3\n"),
+		model.NewCommandBlock([]model.Label{"after"}, "echo after ${x:-unset}\n"),
+		model.NewCommandBlock([]model.Label{"tidy", model.CleanupLabel}, "echo tidy\n")}
+	p := NewProgram(timeout, model.AnyLabel, []model.FileName{}).
+		Add(model.NewScript("iAmFileName", blocks))
+	var out bytes.Buffer
+	if err := p.Step(strings.NewReader("r\nr\nr\nr\nr\n"), &out); err != nil {
+		t.Fatal(err)
+	}
+	wd, err := os.Getwd()
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, want := range []string{
+		dir + "\n(exit status 1)\n",
+		wd + "\n(exit status 0)\n",
+		"(the shell exited with status 3;",
+		"after unset\n(exit status 0)\n",
+		"tidy\n(exit status 0)\n",
+		"Ran 5 blocks, skipped 0, of 5.\n",
+	} {
+		if !strings.Contains(out.String(), want) {
+			t.Errorf("expected %q in\n%s", want, out.String())
+		}
+	}
+}
@@ -0,0 +1,87 @@
+package program
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// pollInterval is how often a readiness condition is checked.
+const pollInterval = 100 * time.Millisecond
+
+// awaitReadiness waits for the given block's readiness condition, if
+// it has one, checking it every pollInterval until it holds or the
+// block's wait timeout passes.  Lines printed by the block's shell are
+// looked for in s, and a relative file path is taken as relative to
+// the block's directory (see model.AttrDir), if it has one.
+func awaitReadiness(block *model.CommandBlock, s *session) error {
+	r := block.WaitFor()
+	if r == nil {
+		return nil
+	}
+	timeout := block.WaitTimeout()
+	deadline := time.Now().Add(timeout)
+	for {
+		err := checkReadiness(r, block.Dir(), s)
+		if err == nil {
+			return nil
+		}
+		if time.Now().After(deadline) {
+			return &model.NotReadyError{Readiness: r, Timeout: timeout, Reason: err}
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// checkReadiness returns nil if the condition holds, else why not.
+// Relative file paths are relative to dir, if not empty.
+func checkReadiness(r *model.Readiness, dir string, s *session) error {
+	switch r.Kind {
+	case model.ReadyTCP:
+		conn, err := net.DialTimeout("tcp", r.Target, time.Second)
+		if err != nil {
+			return err
+		}
+		return conn.Close()
+	case model.ReadyFile:
+		_, err := os.Stat(resolvePath(dir, r.Target))
+		return err
+	case model.ReadyHTTP:
+		client := http.Client{Timeout: time.Second}
+		resp, err := client.Get(r.Target)
+		if err != nil {
+			return err
+		}
+		resp.Body.Close()
+		if resp.StatusCode/100 != 2 {
+			return fmt.Errorf("got status %s", resp.Status)
+		}
+		return nil
+	case model.ReadyStdout:
+		if s.printed(r.Pattern) {
+			return nil
+		}
+		return errors.New("no line printed matches")
+	}
+	return fmt.Errorf("unknown readiness condition %s", r)
+}
+
+// resolvePath returns the path relative to dir, if it's relative and
+// dir isn't empty.  As in quoteDir, a dir starting with ~ is in the
+// home directory.
+func resolvePath(dir, path string) string {
+	if dir == "" || filepath.IsAbs(path) {
+		return path
+	}
+	if dir == "~" || strings.HasPrefix(dir, "~/") {
+		dir = os.Getenv("HOME") + dir[1:]
+	}
+	return filepath.Join(dir, path)
+}
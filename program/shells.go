@@ -0,0 +1,389 @@
+package program
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/scanner"
+	"github.com/monopole/mdrip/util"
+)
+
+// session is a bash subprocess running the blocks given to one of the
+// shells of a run (see model.AttrShell).
+//
+// When a run has more than one shell, they run at the same time, e.g.
+// a server in one and its client in another, but blocks start one at
+// a time, in document order.  Each shell waits for a line on its gate
+// before running its next block.  Shells also wait their turn when a
+// block has a readiness condition (see model.Readiness), or expected
+// output (see model.Expectation), so that it can be checked before
+// the next block runs.  A block whose readiness condition holds while
+// it's still running, e.g. a server in the foreground, is left running
+// alongside the blocks that follow (see awaitBlock).
+type session struct {
+	name     string
+	scripts  []*model.Script // The blocks the shell runs.
+	cmd      *exec.Cmd
+	fileName string // Temp file holding the shell's script.
+	smap     *sourceMap
+	gate     *os.File // Lets the shell run its next block; nil if it needn't wait.
+	stdOut   io.ReadCloser
+	stdErr   io.ReadCloser
+	chOut    <-chan scanner.Line
+	chAccOut <-chan *model.BlockOutput
+	chAccErr <-chan *model.BlockOutput
+	detach   chan bool // Stops the clock of a block left running.
+	stopped  bool      // The shell was killed to stop a block left running.
+	mu       sync.Mutex
+	lines    []string // Lines printed to stdout since the block started.
+	// Blocks the shell runs as it exits, and where their output goes.
+	cleanups   []*model.CommandBlock
+	cleanupLog string
+	grace      time.Duration // Time the shell has to exit when told to.
+	sentinels  *scanner.Sentinels
+	statusFile string // Temp file to which exitTrap writes the shell's exit status.
+}
+
+// The shell's file descriptors, besides the standard ones.  Exit
+// statuses are reported on a descriptor of their own, rather than
+// in a block's output, where they could be confused with it.
+const (
+	statusFd = 3 // Where exitTrap writes the shell's exit status.
+	secretFd = 4 // Where the shell reads the run's secret (see readSecret).
+	gateFd   = 5 // Where the shell reads its turns, if gated.
+)
+
+// secretVar names the shell variable holding the secret in the run's
+// sentinels.  It isn't exported, so the programs a block runs don't
+// see it.
+const secretVar = "mdrip_secret"
+
+// readSecret makes the shell read the run's secret, which its script
+// mustn't hold, before running the script.
+var readSecret = fmt.Sprintf("read -r %s <&%d; exec %d<&-", secretVar, secretFd, secretFd)
+
+// sentinel returns shell text expanding to the sentinel starting with
+// the given scanner.Msg constant.  Sentinels only count at the start
+// of a line, so the text should start a line, e.g. by following echo.
+// Thus a block tracing commands with "set -x" doesn't fake one.
+func sentinel(msg string) string {
+	return msg + "_$" + secretVar
+}
+
+// gateLine makes a shell wait for its turn to run the next block,
+// then announce that the block is starting.  The shell quits if told
+// there are no more turns.
+func gateLine() string {
+	return fmt.Sprintf("read -r -u %d mdrip_go || exit 0; echo %s\n", gateFd, sentinel(scanner.MsgStart))
+}
+
+// byShell splits the given scripts by the shell their blocks run in,
+// returning the shell names in order of first use.
+func byShell(scripts []*model.Script) ([]string, map[string][]*model.Script) {
+	names := []string{}
+	result := map[string][]*model.Script{}
+	for _, script := range scripts {
+		blocks := map[string][]*model.CommandBlock{}
+		for _, block := range script.Blocks() {
+			name := block.Shell()
+			if _, ok := result[name]; !ok {
+				names = append(names, name)
+				result[name] = []*model.Script{}
+			}
+			blocks[name] = append(blocks[name], block)
+		}
+		for _, name := range names {
+			if len(blocks[name]) > 0 {
+				result[name] = append(result[name], model.NewScript(script.FileName(), blocks[name]))
+			}
+		}
+	}
+	return names, result
+}
+
+// startShells starts a shell for each of the shells named by the
+// given scripts' blocks, in order of first use.
+func (p *Program) startShells(scripts []*model.Script) []*session {
+	names, scriptsByName := byShell(scripts)
+	shells := []*session{}
+	gated := len(names) > 1 || awaitsReadiness(scripts) || expectsOutput(scripts)
+	sentinels := scanner.NewSentinels()
+	for _, name := range names {
+		shells = append(shells, p.startShell(name, scriptsByName[name], gated, sentinels))
+	}
+	return shells
+}
+
+// awaitsReadiness is true if any of the given scripts' blocks has a
+// readiness condition.
+func awaitsReadiness(scripts []*model.Script) bool {
+	for _, script := range scripts {
+		for _, block := range script.Blocks() {
+			if block.WaitFor() != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// expectsOutput is true if any of the given scripts' blocks has
+// expected output.  A block printing something else must stop the
+// shell before the next block runs.
+func expectsOutput(scripts []*model.Script) bool {
+	for _, script := range scripts {
+		for _, block := range script.Blocks() {
+			if block.Expectation() != nil {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// startShell starts a shell running the blocks of the given scripts,
+// waiting for its turn before each block if gated, and signalling
+// with the given sentinels.
+func (p *Program) startShell(
+	name string, scripts []*model.Script, gated bool, sentinels *scanner.Sentinels) *session {
+	// Write program to a file to be executed.
+	tmpFile, err := ioutil.TempFile("", "mdrip-script-")
+	check("create temp file", err)
+	check("chmod temp file", os.Chmod(tmpFile.Name(), 0744))
+	smap := newSourceMap(tmpFile.Name())
+	sw := newScriptWriter(tmpFile, smap, sentinels)
+	cleanups := []*model.CommandBlock{}
+	for _, script := range scripts {
+		for _, block := range script.Blocks() {
+			if block.Cleanup() {
+				cleanups = append(cleanups, block)
+			}
+		}
+	}
+	cleanupLog := ""
+	if len(cleanups) > 0 {
+		logFile, err := ioutil.TempFile("", "mdrip-cleanup-")
+		check("create cleanup log", err)
+		check("close cleanup log", logFile.Close())
+		cleanupLog = logFile.Name()
+		p.writeCleanup(sw, cleanups, cleanupLog)
+	}
+	for _, script := range scripts {
+		for i, block := range script.Blocks() {
+			if block.Cleanup() {
+				continue
+			}
+			if gated {
+				sw.emit(gateLine())
+			}
+			p.writeBlock(sw, i, block)
+		}
+	}
+	if gated {
+		// Wait for the other shells to finish before cleaning up.
+		sw.emit(gateLine())
+	}
+	check("close temp file", tmpFile.Close())
+	if glog.V(2) {
+		glog.Info("RunInSubShell: running commands from %s", tmpFile.Name())
+	}
+
+	// Adding "-e" to force the subshell to die on any error.  The
+	// script is sourced, rather than run directly, so that the trap
+	// reporting the failing command doesn't shift its line numbers.
+	cmd := exec.Command("bash", "-e", "-c",
+		readSecret+"; "+errTrap+"; "+exitTrap+`; source "$0"`, tmpFile.Name())
+	// The shell leads its own process group, so that everything it
+	// starts can be killed when a block times out or the run ends.
+	cmd.SysProcAttr = util.NewGroupAttr()
+
+	stdIn, err := cmd.StdinPipe()
+	check("in pipe", err)
+	check("close shell's stdin", stdIn.Close())
+
+	stdOut, err := cmd.StdoutPipe()
+	check("out pipe", err)
+
+	stdErr, err := cmd.StderrPipe()
+	check("err pipe", err)
+
+	status, err := ioutil.TempFile("", "mdrip-status-")
+	check("create status file", err)
+	secret, secretW, err := os.Pipe()
+	check("secret pipe", err)
+	write(secretW, sentinels.Secret+"\n")
+	check("close secret pipe", secretW.Close())
+	cmd.ExtraFiles = []*os.File{status, secret}
+	var gate, turns *os.File
+	if gated {
+		turns, gate, err = os.Pipe()
+		check("gate pipe", err)
+		cmd.ExtraFiles = append(cmd.ExtraFiles, turns)
+	}
+
+	check("shell start", cmd.Start())
+	status.Close()
+	secret.Close()
+	if turns != nil {
+		turns.Close()
+	}
+	if glog.V(2) {
+		glog.Info("RunInSubShell: shell %q has pgid %d", name, cmd.Process.Pid)
+	}
+	return &session{
+		name, scripts, cmd, tmpFile.Name(), smap, gate, stdOut, stdErr,
+		nil, nil, nil, make(chan bool, 1), false, sync.Mutex{}, nil,
+		cleanups, cleanupLog, killGrace + p.cleanupTime(cleanups),
+		sentinels, status.Name()}
+}
+
+// pgid returns the id of the shell's process group.
+func (s *session) pgid() int {
+	return s.cmd.Process.Pid
+}
+
+// proceed lets the shell run its next block.
+func (s *session) proceed() {
+	s.mu.Lock()
+	s.lines = nil
+	s.mu.Unlock()
+	if s.gate != nil {
+		write(s.gate, "\n")
+	}
+}
+
+// clearDetach takes back the value telling accumulateOutput to stop
+// the clock of a block left running, in case the block finished
+// before accumulateOutput saw it.  Else it would stop the clock of
+// the shell's next block.
+func (s *session) clearDetach() {
+	select {
+	case <-s.detach:
+	default:
+	}
+}
+
+// saw notes a line the shell printed to stdout.
+func (s *session) saw(line string) {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	s.lines = append(s.lines, line)
+}
+
+// watch returns a function noting lines the shell prints to stdout,
+// before passing them on to onLine, if not nil.
+func (s *session) watch(onLine func(int, string)) func(int, string) {
+	return func(index int, line string) {
+		s.saw(line)
+		if onLine != nil {
+			onLine(index, line)
+		}
+	}
+}
+
+// printed is true if the shell has printed a line matching re to
+// stdout since its current block started.
+func (s *session) printed(re *regexp.Regexp) bool {
+	s.mu.Lock()
+	defer s.mu.Unlock()
+	for _, line := range s.lines {
+		if re.MatchString(line) {
+			return true
+		}
+	}
+	return false
+}
+
+// closeGate tells a shell waiting its turn that there are no more
+// turns, so that it quits.
+func (s *session) closeGate() {
+	if s.gate != nil {
+		s.gate.Close()
+		s.gate = nil
+	}
+}
+
+// wait waits for the shell to exit, which it should be about to do,
+// killing it if it takes longer than its grace period, e.g. because a
+// cleanup block hangs.
+func (s *session) wait(p *Program) error {
+	done := make(chan error, 1)
+	go func() {
+		done <- s.cmd.Wait()
+	}()
+	select {
+	case err := <-done:
+		return err
+	case <-time.After(s.grace):
+		glog.Warningf("Shell %q didn't exit in %v.", s.name, s.grace)
+		p.reap(s.pgid(), killGrace)
+		return <-done
+	}
+}
+
+// exitStatus returns the status the shell exited with, as reported
+// by exitTrap, or model.UnknownExitCode if the shell hasn't exited or
+// was killed before it could say.
+func (s *session) exitStatus() int {
+	contents, err := ioutil.ReadFile(s.statusFile)
+	if err != nil {
+		return model.UnknownExitCode
+	}
+	code, err := strconv.Atoi(strings.TrimSpace(string(contents)))
+	if err != nil {
+		return model.UnknownExitCode
+	}
+	return code
+}
+
+// remove deletes the shell's temp files.
+func (s *session) remove() {
+	check("delete temp file", os.Remove(s.fileName))
+	check("delete status file", os.Remove(s.statusFile))
+	if s.cleanupLog != "" {
+		check("delete cleanup log", os.Remove(s.cleanupLog))
+	}
+}
+
+// shellFor returns the session running the given block, or nil.
+func shellFor(shells []*session, block *model.CommandBlock) *session {
+	if block == nil {
+		return nil
+	}
+	for _, s := range shells {
+		if s.name == block.Shell() {
+			return s
+		}
+	}
+	return nil
+}
+
+// pgids returns the process groups of the given shells.
+func pgids(shells []*session) []int {
+	result := []int{}
+	for _, s := range shells {
+		result = append(result, s.pgid())
+	}
+	return result
+}
+
+// maxGrace returns the longest grace period of the given shells.
+func maxGrace(shells []*session) time.Duration {
+	result := killGrace
+	for _, s := range shells {
+		if s.grace > result {
+			result = s.grace
+		}
+	}
+	return result
+}
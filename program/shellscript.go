@@ -0,0 +1,118 @@
+package program
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/scanner"
+)
+
+// scriptWriter writes a bash script, counting lines as it goes so
+// that a sourceMap can be built.
+type scriptWriter struct {
+	w         io.Writer
+	line      int // Number of the next line to be written.
+	smap      *sourceMap
+	sentinels *scanner.Sentinels
+}
+
+func newScriptWriter(w io.Writer, smap *sourceMap, sentinels *scanner.Sentinels) *scriptWriter {
+	return &scriptWriter{w, 1, smap, sentinels}
+}
+
+func (sw *scriptWriter) emit(text string) {
+	write(sw.w, text)
+	sw.line += strings.Count(text, "\n")
+}
+
+// writeBlock writes a block's code, wrapped as its language and
+// attributes require, followed by a line announcing its success, and
+// its exit status.
+func (p *Program) writeBlock(sw *scriptWriter, i int, b *model.CommandBlock) {
+	p.wrapBlock(sw, i, b)
+	// Announce success on both streams, so that each stream's output
+	// can be attributed to a block.  The announcement follows a line
+	// end of its own, so that it starts a line even if the block's
+	// output doesn't end one (see accumulateOutput).  Use one line, so
+	// that the announcement doesn't shift the line numbers of
+	// subsequent blocks.
+	happy := "echo; echo " + sentinel(scanner.MsgHappy) + " $mdrip_status " + b.Name().String()
+	sw.emit(happy + "; { " + happy + "; } >&2\n")
+}
+
+// wrapBlock writes a block's code, wrapped as its language and
+// attributes require, leaving the block's exit status in
+// $mdrip_status.  Whether a failure stops the shell is up to the
+// caller, who may turn off errexit (see writeCleanup).
+func (p *Program) wrapBlock(sw *scriptWriter, i int, b *model.CommandBlock) {
+	var before, after []string
+	if dir := b.Dir(); dir != "" {
+		before = append(before, "pushd "+quoteDir(dir)+" >/dev/null")
+		after = append([]string{"popd >/dev/null"}, after...)
+	}
+	if n := b.Retries(); n > 0 {
+		// Each attempt runs in a subshell, so that a failed attempt
+		// doesn't take down the script.  Hence changes a retried block
+		// makes to shell state don't outlive the block.  The command
+		// failing within the subshell is reported, so a failed attempt
+		// isn't reported again as the failure of the whole subshell.
+		// The last failed attempt ends the shell only if errexit was on.
+		before = append(before,
+			"mdrip_e=${-//[^e]/}",
+			fmt.Sprintf("for mdrip_try in $(seq %d); do", n+1),
+			"set +e",
+			"trap - ERR",
+			"(",
+			"set -e",
+			errTrap)
+		after = append([]string{
+			")",
+			"mdrip_status=$?",
+			errTrap,
+			`[ -z "$mdrip_e" ] || set -e`,
+			"if [ $mdrip_status -eq 0 ]; then break; fi",
+			fmt.Sprintf(`if [ $mdrip_try -gt %d ]; then [ -z "$mdrip_e" ] || exit $mdrip_status; break; fi`, n),
+			fmt.Sprintf("echo \"mdrip: retrying @%s after failed attempt $mdrip_try\" >&2", b.Name()),
+			"done"}, after...)
+	} else {
+		after = append([]string{"mdrip_status=$?"}, after...)
+	}
+	if command, ok := p.interpreterFor(b); ok {
+		// A block can't hold the delimiter, and so end the here
+		// document early, without knowing the run's nonce.
+		delim := fmt.Sprintf("MDRIP_EOF_%s_%d", sw.sentinels.Nonce, i)
+		before = append(before, fmt.Sprintf("%s <<'%s'", command, delim))
+		after = append([]string{delim}, after...)
+	}
+	sw.smap.add(sw.line, len(before), len(after), b)
+	for _, s := range before {
+		sw.emit(s + "\n")
+	}
+	code := b.Code().String()
+	sw.emit(code)
+	if !strings.HasSuffix(code, "\n") {
+		sw.emit("\n")
+	}
+	for _, s := range after {
+		sw.emit(s + "\n")
+	}
+}
+
+// shellQuote quotes s for bash, so that it's taken literally.
+func shellQuote(s string) string {
+	return "'" + strings.Replace(s, "'", `'\''`, -1) + "'"
+}
+
+// quoteDir quotes a directory named by a block, which is taken
+// literally, except that a leading ~ means the home directory.
+func quoteDir(dir string) string {
+	if dir == "~" {
+		return `"$HOME"`
+	}
+	if strings.HasPrefix(dir, "~/") {
+		return `"$HOME"/` + shellQuote(dir[2:])
+	}
+	return shellQuote(dir)
+}
@@ -0,0 +1,81 @@
+package program
+
+import (
+	"fmt"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// span is a run of generated script lines holding one block's code.
+type span struct {
+	first int // First script line, 1-based.
+	code  int // Script line holding the first line of code.
+	last  int // Last script line, inclusive.
+	block *model.CommandBlock
+}
+
+// sourceMap maps lines of a generated script back to the markdown
+// lines they were extracted from, so that shell diagnostics can
+// refer to something a document author recognizes.
+type sourceMap struct {
+	scriptName string
+	spans      []span
+	bashLine   *regexp.Regexp
+}
+
+func newSourceMap(scriptName string) *sourceMap {
+	return &sourceMap{
+		scriptName, []span{},
+		regexp.MustCompile(regexp.QuoteMeta(scriptName) + `: line (\d+): `)}
+}
+
+// add notes that the given block starts at the given script line,
+// with its code between skip lines and trail lines written by mdrip,
+// e.g. those of a here document or a retry loop.  Those lines map to
+// the block's first and last lines respectively.
+func (m *sourceMap) add(line, skip, trail int, b *model.CommandBlock) {
+	n := strings.Count(strings.TrimSuffix(b.Code().String(), "\n"), "\n")
+	m.spans = append(m.spans, span{line, line + skip, line + skip + n + trail, b})
+}
+
+// lookup returns the markdown location of the given script line.
+// The boolean is false if the line didn't come from markdown.
+func (m *sourceMap) lookup(line int) (model.FileName, int, bool) {
+	for _, s := range m.spans {
+		if line < s.first || line > s.last {
+			continue
+		}
+		if s.block.FirstLine() < 1 {
+			return "", 0, false
+		}
+		mdLine := s.block.FirstLine()
+		if line > s.code {
+			mdLine += line - s.code
+		}
+		if mdLine > s.block.LastLine() {
+			// E.g. a line mdrip itself appended to the block, or
+			// wrapped it in.
+			mdLine = s.block.LastLine()
+		}
+		return s.block.FileName(), mdLine, true
+	}
+	return "", 0, false
+}
+
+// rewrite replaces bash's "script: line N: " diagnostic prefixes with
+// "file.md:M: " wherever a mapping is known.
+func (m *sourceMap) rewrite(text string) string {
+	return m.bashLine.ReplaceAllStringFunc(text, func(s string) string {
+		n, err := strconv.Atoi(m.bashLine.FindStringSubmatch(s)[1])
+		if err != nil {
+			return s
+		}
+		if fileName, line, ok := m.lookup(n); ok {
+			return fmt.Sprintf("%s:%d: ", fileName, line)
+		}
+		return s
+	})
+}
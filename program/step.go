@@ -0,0 +1,314 @@
+package program
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/scanner"
+	"github.com/monopole/mdrip/util"
+)
+
+// defaultEditor edits blocks in step mode if $EDITOR isn't set.
+const defaultEditor = "vi"
+
+// ttyName is the terminal step mode reads answers from when the
+// markdown itself comes from stdin.
+var ttyName = "/dev/tty"
+
+// stepShell is a bash subprocess that runs blocks one at a time,
+// keeping its state between them.
+type stepShell struct {
+	cmd  *exec.Cmd
+	in   io.WriteCloser
+	pipe *os.File // Read end of the shell's stdout and stderr.
+	out  *bufio.Reader
+	pgid int
+	// Sentinels.Happy follows the output of each block, along with the
+	// block's exit status.
+	sentinels *scanner.Sentinels
+}
+
+func newStepShell() (*stepShell, error) {
+	cmd := exec.Command("bash")
+	in, err := cmd.StdinPipe()
+	if err != nil {
+		return nil, err
+	}
+	// Merge stderr into stdout, so that output appears in the order
+	// it's written.
+	r, w, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+	cmd.Stdout, cmd.Stderr = w, w
+	cmd.SysProcAttr = util.NewGroupAttr()
+	if err := cmd.Start(); err != nil {
+		return nil, err
+	}
+	w.Close()
+	s := &stepShell{
+		cmd, in, r, bufio.NewReader(r), cmd.Process.Pid, scanner.NewSentinels()}
+	// The secret is set before any block runs, so can't be echoed by
+	// a block running "set -v".
+	fmt.Fprintf(in, "%s=%s\n", secretVar, s.sentinels.Secret)
+	return s, nil
+}
+
+// run sources the given script, copying its output to w as it
+// arrives, and returns its exit status, or the shell's if the script
+// made it exit (see exited).  The script reads from /dev/null, so it
+// can't consume the commands that follow it.
+func (s *stepShell) run(script string, w io.Writer) (int, error) {
+	f, err := ioutil.TempFile("", "mdrip-step-")
+	if err != nil {
+		return 0, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(script); err != nil {
+		return 0, err
+	}
+	f.Close()
+	fmt.Fprintf(s.in, "source %s </dev/null; mdrip_status=$?; echo; echo \"%s $mdrip_status\"\n",
+		f.Name(), sentinel(scanner.MsgHappy))
+	// Output is copied a piece at a time, so that a line of any length
+	// can pass, holding back enough of a piece ending mid-line to find
+	// the sentinel in, should it be split between pieces.  The sentinel
+	// only counts at the start of a line, and follows a line end of its
+	// own, which isn't output, so the last line end seen is held back
+	// until it's known whether the sentinel follows.  Pending starts
+	// with a line end that isn't output at all.
+	happy := []byte("\n" + s.sentinels.Happy)
+	pending := []byte("\n")
+	skip := 1 // Bytes at the start of pending that aren't output.
+	for {
+		piece, err := s.out.ReadSlice('\n')
+		pending = append(pending, piece...)
+		if i := bytes.Index(pending, happy); i > -1 && err == nil {
+			if i > skip {
+				w.Write(pending[skip:i])
+			}
+			return strconv.Atoi(strings.TrimSpace(string(pending[i+len(happy):])))
+		}
+		if err == bufio.ErrBufferFull {
+			if n := len(pending) - len(happy); n > skip {
+				w.Write(pending[skip:n])
+				pending = append(pending[:0], pending[n:]...)
+				skip = 0
+			}
+			continue
+		}
+		if err != nil {
+			w.Write(pending[skip:])
+			return exitCode(s.cmd.Wait()), nil
+		}
+		if n := len(pending) - 1; n > skip {
+			w.Write(pending[skip:n])
+			pending = append(pending[:0], '\n')
+			skip = 0
+		}
+	}
+}
+
+// exited is true once the shell has exited, e.g. because a block
+// called exit.
+func (s *stepShell) exited() bool {
+	return s.cmd.ProcessState != nil
+}
+
+func (s *stepShell) close() {
+	s.in.Close()
+	s.cmd.Wait()
+	s.pipe.Close()
+}
+
+// stepScript returns the script running a block in step mode, in the
+// block's directory and fed to its interpreter, if need be.  The
+// script's status is the block's.
+func (s *stepShell) stepScript(p *Program, b *model.CommandBlock, code string) string {
+	script := code
+	if command, ok := p.interpreterFor(b); ok {
+		delim := "MDRIP_EOF_" + s.sentinels.Nonce
+		script = fmt.Sprintf("%s <<'%s'\n%s%s\n", command, delim, code, delim)
+	}
+	if dir := b.Dir(); dir != "" {
+		// Unlike in test mode, the shell carries on after a failure, so
+		// the block mustn't run elsewhere if pushd fails, and its status
+		// must outlast popd.
+		script = fmt.Sprintf("pushd %s >/dev/null && {\n%s\n"+
+			"mdrip_status=$?; popd >/dev/null; (exit $mdrip_status)\n}\n", quoteDir(dir), script)
+	}
+	return script
+}
+
+// StepInput returns where Step should read the user's answers:
+// stdin, unless the markdown was read from stdin, in which case the
+// terminal.  It's an error if there's no terminal to read from.
+func (p *Program) StepInput() (*os.File, error) {
+	for _, arg := range p.fileNames {
+		if arg == stdinArg {
+			f, err := os.Open(ttyName)
+			if err != nil {
+				return nil, fmt.Errorf(
+					"markdown was read from stdin, so step mode needs a terminal for answers: %v", err)
+			}
+			return f, nil
+		}
+	}
+	return os.Stdin, nil
+}
+
+// editCode lets the user change code with their editor, returning
+// the changed code.  The editor reads from in.
+func editCode(code string, in *os.File) (string, error) {
+	f, err := ioutil.TempFile("", "mdrip-edit-")
+	if err != nil {
+		return code, err
+	}
+	defer os.Remove(f.Name())
+	if _, err := f.WriteString(code); err != nil {
+		return code, err
+	}
+	f.Close()
+	editor := os.Getenv("EDITOR")
+	if editor == "" {
+		editor = defaultEditor
+	}
+	cmd := exec.Command("sh", "-c", editor+` "$0"`, f.Name())
+	cmd.Stdin, cmd.Stdout, cmd.Stderr = in, os.Stdout, os.Stderr
+	if err := cmd.Run(); err != nil {
+		return code, err
+	}
+	edited, err := ioutil.ReadFile(f.Name())
+	if err != nil {
+		return code, err
+	}
+	return string(edited), nil
+}
+
+// Step walks through the program's blocks, showing each one and
+// asking whether to run, skip or edit it, or to quit.  Blocks run one
+// at a time in a single bash subprocess, or in the shell they name
+// (see model.AttrShell), so that state carries from one block to the
+// next, and their output is shown as it arrives.  A block that exits
+// its shell leaves a new one to run the blocks that follow.  Cleanup
+// blocks come last, and are offered even after quitting.
+//
+// The @dir attribute applies as in test mode; @retry, @timeout and
+// @waitFor don't, as the user sees each block run.
+//
+// Answers are read from in (see StepInput), as is the editor's
+// input when in is a file; otherwise the editor reads stdin.
+func (p *Program) Step(in io.Reader, out io.Writer) error {
+	editorIn := os.Stdin
+	if f, ok := in.(*os.File); ok {
+		editorIn = f
+	}
+	shells := map[string]*stepShell{}
+	pgids := []int{} // Including those of shells that have exited.
+	stopInterrupts := func() {}
+	defer func() {
+		stopInterrupts()
+		for _, shell := range shells {
+			shell.close()
+		}
+		// Processes started in the background may outlive the shells.
+		for _, pgid := range pgids {
+			p.reap(pgid, killGrace)
+		}
+	}()
+	shellFor := func(name string) (*stepShell, error) {
+		if shell, ok := shells[name]; ok {
+			return shell, nil
+		}
+		shell, err := newStepShell()
+		if err != nil {
+			return nil, err
+		}
+		shells[name] = shell
+		pgids = append(pgids, shell.pgid)
+		stopInterrupts()
+		stopInterrupts = killOnInterrupt(killGrace, pgids...)
+		return shell, nil
+	}
+	answers := bufio.NewReader(in)
+	delim := strings.Repeat("-", 70) + "\n"
+	blocks, cleanups := []*model.CommandBlock{}, []*model.CommandBlock{}
+	for _, script := range p.Scripts {
+		for _, block := range script.Blocks() {
+			if block.Cleanup() {
+				cleanups = append(cleanups, block)
+			} else {
+				blocks = append(blocks, block)
+			}
+		}
+	}
+	firstCleanup := len(blocks)
+	blocks = append(blocks, cleanups...)
+	total := len(blocks)
+	ran, skipped := 0, 0
+	for n := 1; n <= total; n++ {
+		block := blocks[n-1]
+		code := block.Code().String()
+		for asking := true; asking; {
+			fmt.Fprint(out, delim)
+			fmt.Fprintf(out, "@%s (block %d of %d) %s\n", block.Name(), n, total, block.Location())
+			fmt.Fprint(out, delim)
+			fmt.Fprint(out, code)
+			fmt.Fprint(out, delim)
+			fmt.Fprint(out, "[r]un, [s]kip, [e]dit or [q]uit? ")
+			answer, err := answers.ReadString('\n')
+			if err != nil && answer == "" {
+				fmt.Fprintln(out)
+				answer = "q"
+			}
+			switch strings.ToLower(strings.TrimSpace(answer)) {
+			case "", "r", "run":
+				shell, err := shellFor(block.Shell())
+				if err != nil {
+					return err
+				}
+				status, err := shell.run(shell.stepScript(p, block, code), out)
+				if err != nil {
+					return err
+				}
+				if shell.exited() {
+					fmt.Fprintf(out, "(the shell exited with status %d; a new one runs the blocks that follow)\n", status)
+					shell.close()
+					delete(shells, block.Shell())
+				} else {
+					fmt.Fprintf(out, "(exit status %d)\n", status)
+				}
+				ran++
+				asking = false
+			case "s", "skip":
+				skipped++
+				asking = false
+			case "e", "edit":
+				if code, err = editCode(code, editorIn); err != nil {
+					fmt.Fprintf(out, "Unable to edit: %v\n", err)
+				}
+			case "q", "quit":
+				if n <= firstCleanup && firstCleanup < total {
+					fmt.Fprintln(out, "Quitting after the cleanup blocks.")
+					n = firstCleanup
+					asking = false
+					continue
+				}
+				fmt.Fprintf(out, "Ran %d blocks, skipped %d, of %d.\n", ran, skipped, total)
+				return nil
+			default:
+				fmt.Fprintf(out, "Please answer r, s, e or q.\n")
+			}
+		}
+	}
+	fmt.Fprintf(out, "Ran %d blocks, skipped %d, of %d.\n", ran, skipped, total)
+	return nil
+}
@@ -0,0 +1,87 @@
+package program
+
+import (
+	"io/ioutil"
+	"os"
+	"sort"
+	"strings"
+
+	"github.com/golang/glog"
+	"github.com/monopole/mdrip/model"
+)
+
+// SetUpdate arranges for RunInSubShell to accept whatever blocks
+// print, so that UpdateExpectations can record it.
+func (p *Program) SetUpdate(update bool) *Program {
+	p.update = update
+	return p
+}
+
+// UpdateExpectations rewrites, in place, the expected output of each
+// block that ran cleanly in the last run but printed something else,
+// returning the names of the files changed.  Other text in the files
+// is left byte-for-byte intact.
+func (p *Program) UpdateExpectations() ([]model.FileName, error) {
+	edits := map[model.FileName][]*model.RunResult{}
+	var fileNames []model.FileName
+	for _, r := range p.results {
+		e := r.Block().Expectation()
+		if e == nil || !r.Succeeded() || r.Problem() != nil || e.Matches(r.Output()) {
+			continue
+		}
+		if e.FileName() == stdinName {
+			glog.Warningf("Unable to update %s in %s.", e.Location(), stdinName)
+			continue
+		}
+		if _, ok := edits[e.FileName()]; !ok {
+			fileNames = append(fileNames, e.FileName())
+		}
+		edits[e.FileName()] = append(edits[e.FileName()], r)
+	}
+	for _, fileName := range fileNames {
+		if err := updateFile(fileName, edits[fileName]); err != nil {
+			return nil, err
+		}
+	}
+	return fileNames, nil
+}
+
+// updateFile replaces the expected output of the given results'
+// blocks in the named file with what the blocks printed.
+func updateFile(fileName model.FileName, results []*model.RunResult) error {
+	info, err := os.Stat(string(fileName))
+	if err != nil {
+		return err
+	}
+	contents, err := ioutil.ReadFile(string(fileName))
+	if err != nil {
+		return err
+	}
+	lines := strings.SplitAfter(string(contents), "\n")
+	// Edit from the bottom up, so that line numbers above stay valid.
+	sort.Slice(results, func(a, b int) bool {
+		return results[a].Block().Expectation().FirstLine() >
+			results[b].Block().Expectation().FirstLine()
+	})
+	for _, r := range results {
+		e := r.Block().Expectation()
+		first, last := e.FirstLine()-1, e.LastLine()
+		if first < 1 || last < first || last > len(lines) {
+			glog.Warningf("Unable to update %s, as the file has changed.", e.Location())
+			continue
+		}
+		// Match the line ending of the fence preceding the output.
+		eol := "\n"
+		if strings.HasSuffix(lines[first-1], "\r\n") {
+			eol = "\r\n"
+		}
+		var replacement []string
+		for _, line := range strings.SplitAfter(e.Update(r.Output()), "\n") {
+			if line != "" {
+				replacement = append(replacement, e.Indent()+strings.TrimSuffix(line, "\n")+eol)
+			}
+		}
+		lines = append(lines[:first], append(replacement, lines[last:]...)...)
+	}
+	return ioutil.WriteFile(string(fileName), []byte(strings.Join(lines, "")), info.Mode())
+}
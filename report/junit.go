@@ -0,0 +1,101 @@
+package report
+
+import (
+	"encoding/xml"
+	"fmt"
+	"io"
+	"time"
+
+	"github.com/monopole/mdrip/model"
+)
+
+type junitTestSuites struct {
+	XMLName xml.Name         `xml:"testsuites"`
+	Suites  []junitTestSuite `xml:"testsuite"`
+}
+
+type junitTestSuite struct {
+	Name      string          `xml:"name,attr"`
+	Timestamp string          `xml:"timestamp,attr,omitempty"`
+	Tests     int             `xml:"tests,attr"`
+	Failures  int             `xml:"failures,attr"`
+	Skipped   int             `xml:"skipped,attr"`
+	Time      string          `xml:"time,attr"`
+	Cases     []junitTestCase `xml:"testcase"`
+}
+
+type junitTestCase struct {
+	Name      string        `xml:"name,attr"`
+	ClassName string        `xml:"classname,attr"`
+	Time      string        `xml:"time,attr"`
+	File      string        `xml:"file,attr,omitempty"`
+	Line      int           `xml:"line,attr,omitempty"`
+	Failure   *junitFailure `xml:"failure,omitempty"`
+	Skipped   *junitSkipped `xml:"skipped,omitempty"`
+	SystemOut string        `xml:"system-out,omitempty"`
+	SystemErr string        `xml:"system-err,omitempty"`
+}
+
+type junitFailure struct {
+	Message string `xml:"message,attr"`
+	Type    string `xml:"type,attr"`
+	Body    string `xml:",chardata"`
+}
+
+type junitSkipped struct {
+	Message string `xml:"message,attr"`
+}
+
+func seconds(d time.Duration) string {
+	return fmt.Sprintf("%.3f", d.Seconds())
+}
+
+// JUnit writes JUnit XML, with a testsuite per markdown file and a
+// testcase per block.
+func JUnit(w io.Writer, results []*model.RunResult) error {
+	report := junitTestSuites{}
+	for _, g := range group(results) {
+		suite := junitTestSuite{Name: string(g[0].FileName())}
+		if start := g[0].Start(); !start.IsZero() {
+			suite.Timestamp = start.Format("2006-01-02T15:04:05")
+		}
+		var total time.Duration
+		for _, r := range g {
+			c := junitTestCase{
+				Name:      testName(r),
+				ClassName: string(r.FileName()),
+				Time:      seconds(r.Duration()),
+				File:      string(r.Block().FileName()),
+				Line:      r.Block().FirstLine(),
+			}
+			switch {
+			case r.Skipped():
+				c.Skipped = &junitSkipped{"not run, since an earlier block failed"}
+				suite.Skipped++
+			case r.Problem() != nil:
+				c.Failure = &junitFailure{
+					firstLine(r.Problem().Error()), failureType(r), r.Problem().Error()}
+				suite.Failures++
+			}
+			if !r.Skipped() {
+				c.SystemOut = r.Output()
+				c.SystemErr = r.Message()
+			}
+			total += r.Duration()
+			suite.Cases = append(suite.Cases, c)
+		}
+		suite.Tests = len(suite.Cases)
+		suite.Time = seconds(total)
+		report.Suites = append(report.Suites, suite)
+	}
+	if _, err := io.WriteString(w, xml.Header); err != nil {
+		return err
+	}
+	e := xml.NewEncoder(w)
+	e.Indent("", "  ")
+	if err := e.Encode(report); err != nil {
+		return err
+	}
+	_, err := io.WriteString(w, "\n")
+	return err
+}
@@ -0,0 +1,113 @@
+package report
+
+import (
+	"bytes"
+	"encoding/xml"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/scanner"
+)
+
+func block(name string, fileName model.FileName, first, last int) *model.CommandBlock {
+	return model.NewCommandBlock([]model.Label{model.Label(name)}, "echo "+name+"\n").
+		SetSource(fileName, first, last)
+}
+
+func testResults() []*model.RunResult {
+	return []*model.RunResult{
+		model.NewBlockRunResult(
+			model.NewSuccessOutput("hello\n"), "a.md", 0, block("hello", "a.md", 3, 5)).
+			SetDuration(1500 * time.Millisecond),
+		model.NewBlockRunResult(
+			model.NewFailureOutput(""), "b.md", 0, block("oops", "b.md", 7, 9)).
+			SetProblem(errors.New("exit status 1")).SetExitCode(127).
+			SetStart(time.Date(2024, 5, 6, 7, 8, 9, 0, time.UTC)).
+			SetMessage("b.md: line 8: oops: command not found\n").
+			SetDuration(20 * time.Millisecond),
+		model.NewBlockRunResult(
+			model.NewSkippedOutput(), "b.md", 1, block("later", "b.md", 12, 12)),
+	}
+}
+
+func TestJUnit(t *testing.T) {
+	var buf bytes.Buffer
+	if err := JUnit(&buf, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	var got junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unparsable report: %v\n%s", err, buf.String())
+	}
+	if len(got.Suites) != 2 {
+		t.Fatalf("expected a suite per file, got %d", len(got.Suites))
+	}
+	a, b := got.Suites[0], got.Suites[1]
+	if a.Name != "a.md" || a.Tests != 1 || a.Failures != 0 || a.Time != "1.500" {
+		t.Errorf("bad suite a: %+v", a)
+	}
+	if b.Name != "b.md" || b.Timestamp != "2024-05-06T07:08:09" || b.Tests != 2 || b.Failures != 1 || b.Skipped != 1 {
+		t.Errorf("bad suite b: %+v", b)
+	}
+	if c := a.Cases[0]; c.Name != "@hello a.md:3-5" || c.SystemOut != "hello\n" || c.Line != 3 {
+		t.Errorf("bad case: %+v", c)
+	}
+	failed := b.Cases[0]
+	if failed.Failure == nil || failed.Failure.Message != "exit status 1" ||
+		failed.Failure.Type != "exit-127" {
+		t.Errorf("expected failure, got %+v", failed)
+	}
+	if !strings.Contains(failed.SystemErr, "line 8: oops") {
+		t.Errorf("expected stderr, got %q", failed.SystemErr)
+	}
+	if skipped := b.Cases[1]; skipped.Skipped == nil || skipped.Name != "@later b.md:12" {
+		t.Errorf("expected skipped case, got %+v", skipped)
+	}
+}
+
+func TestJUnitCleanupLast(t *testing.T) {
+	// Cleanup results come after those of later files.
+	results := append(testResults(), model.NewBlockRunResult(
+		model.NewSuccessOutput(""), "a.md", 1, block("tidy", "a.md", 20, 22)))
+	var buf bytes.Buffer
+	if err := JUnit(&buf, results); err != nil {
+		t.Fatal(err)
+	}
+	var got junitTestSuites
+	if err := xml.Unmarshal(buf.Bytes(), &got); err != nil {
+		t.Fatalf("unparsable report: %v\n%s", err, buf.String())
+	}
+	if len(got.Suites) != 2 || got.Suites[0].Name != "a.md" || got.Suites[0].Tests != 2 {
+		t.Fatalf("expected the cleanup block in the first suite, got %+v", got.Suites)
+	}
+	if c := got.Suites[0].Cases[1]; c.Name != "@tidy a.md:20-22" {
+		t.Errorf("bad case: %+v", c)
+	}
+}
+
+func TestFailureType(t *testing.T) {
+	b := block("x", "x.md", 1, 1)
+	failed := func() *model.RunResult {
+		return model.NewBlockRunResult(model.NewFailureOutput(""), "x.md", 0, b).
+			SetDuration(20 * time.Millisecond)
+	}
+	for _, c := range []struct {
+		result *model.RunResult
+		want   string
+	}{
+		{failed().SetProblem(errors.New("oops")).SetExitCode(127), "exit-127"},
+		{failed().SetProblem(errors.New(scanner.MsgTimeout)), "timeout"},
+		{failed().SetProblem(&model.MismatchError{
+			Expectation: model.NewExpectation("a\n"), Output: "b\n"}).SetExitCode(0), "mismatch"},
+		{failed().SetProblem(&model.NotReadyError{
+			Readiness: &model.Readiness{Kind: model.ReadyFile, Target: "/tmp/x"}}), "not-ready"},
+		{failed().SetProblem(errors.New("unknown")), "error"},
+	} {
+		if got := failureType(c.result); got != c.want {
+			t.Errorf("%v: got %q, want %q", c.result.Problem(), got, c.want)
+		}
+	}
+}
@@ -0,0 +1,84 @@
+// Package report writes the results of running command blocks in
+// formats understood by other tools, e.g. CI dashboards.
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+
+	"github.com/monopole/mdrip/model"
+	"github.com/monopole/mdrip/scanner"
+)
+
+// A Writer writes a report on the given results, which hold one
+// result per block in order of execution.
+type Writer func(w io.Writer, results []*model.RunResult) error
+
+// Writers maps report format names to Writers.
+var Writers = map[string]Writer{
+	"junit":   JUnit,
+	"tap":     TAP,
+	"summary": Summary,
+}
+
+// group splits results by file name, in order of each file's first
+// result, preserving order within a file.  A file's results needn't
+// be together, e.g. its cleanup blocks run after other files' blocks.
+func group(results []*model.RunResult) [][]*model.RunResult {
+	groups := [][]*model.RunResult{}
+	index := map[model.FileName]int{}
+	for _, r := range results {
+		i, ok := index[r.FileName()]
+		if !ok {
+			i = len(groups)
+			index[r.FileName()] = i
+			groups = append(groups, []*model.RunResult{})
+		}
+		groups[i] = append(groups[i], r)
+	}
+	return groups
+}
+
+// location returns where the result's block came from, e.g.
+// "docs/setup.md:42-57".
+func location(r *model.RunResult) string {
+	if r.Block().FileName() == "" {
+		return string(r.FileName())
+	}
+	return r.Block().Location()
+}
+
+// testName returns a name for the block's test, e.g.
+// "@install docs/setup.md:42-57".
+func testName(r *model.RunResult) string {
+	return "@" + r.Block().Name().String() + " " + location(r)
+}
+
+// failureType classifies a failed result, e.g. "exit-127",
+// "timeout", "mismatch" or "not-ready", for tools grouping failures.
+// Unlike a message, it doesn't vary from run to run.
+func failureType(r *model.RunResult) string {
+	switch r.Problem().(type) {
+	case *model.MismatchError:
+		return "mismatch"
+	case *model.NotReadyError:
+		return "not-ready"
+	}
+	switch {
+	case r.Problem().Error() == scanner.MsgTimeout:
+		return "timeout"
+	case r.ExitCode() > 0:
+		return fmt.Sprintf("exit-%d", r.ExitCode())
+	}
+	return "error"
+}
+
+// firstLine returns the first non-blank line of s.
+func firstLine(s string) string {
+	s = strings.TrimSpace(s)
+	if i := strings.Index(s, "\n"); i > -1 {
+		return s[:i]
+	}
+	return s
+}
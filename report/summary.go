@@ -0,0 +1,42 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"text/tabwriter"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// Summary writes a table with a row per block giving its status,
+// location and duration, followed by a line of totals.
+func Summary(w io.Writer, results []*model.RunResult) error {
+	tw := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+	fmt.Fprintln(tw, "STATUS\tEXIT\tBLOCK\tLOCATION\tTIME")
+	passed, failed, skipped := 0, 0, 0
+	for _, r := range results {
+		status, elapsed := "pass", fmt.Sprintf("%.2fs", r.Duration().Seconds())
+		switch {
+		case r.Skipped():
+			status, elapsed = "skip", "-"
+			skipped++
+		case r.Problem() != nil:
+			status = "FAIL"
+			failed++
+		default:
+			passed++
+		}
+		exit := "-"
+		if r.ExitCode() != model.UnknownExitCode {
+			exit = fmt.Sprint(r.ExitCode())
+		}
+		fmt.Fprintf(tw, "%s\t%s\t@%s\t%s\t%s\n",
+			status, exit, r.Block().Name(), location(r), elapsed)
+	}
+	if err := tw.Flush(); err != nil {
+		return err
+	}
+	_, err := fmt.Fprintf(w, "%d blocks: %d passed, %d failed, %d skipped\n",
+		len(results), passed, failed, skipped)
+	return err
+}
@@ -0,0 +1,22 @@
+package report
+
+import (
+	"bytes"
+	"testing"
+)
+
+func TestSummary(t *testing.T) {
+	var buf bytes.Buffer
+	if err := Summary(&buf, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	want := `STATUS  EXIT  BLOCK   LOCATION  TIME
+pass    0     @hello  a.md:3-5  1.50s
+FAIL    127   @oops   b.md:7-9  0.02s
+skip    -     @later  b.md:12   -
+3 blocks: 1 passed, 1 failed, 1 skipped
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
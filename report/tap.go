@@ -0,0 +1,85 @@
+package report
+
+import (
+	"fmt"
+	"io"
+	"strings"
+	"time"
+	"unicode"
+
+	"github.com/monopole/mdrip/model"
+)
+
+// TAP writes a TAP version 13 stream, with a test point per block,
+// named like "@install docs/setup.md:42".  Failures carry a YAML
+// diagnostic block holding captured output.
+func TAP(w io.Writer, results []*model.RunResult) error {
+	var b strings.Builder
+	b.WriteString("TAP version 13\n")
+	fmt.Fprintf(&b, "1..%d\n", len(results))
+	for i, r := range results {
+		name := pointName(r)
+		switch {
+		case r.Skipped():
+			fmt.Fprintf(&b, "ok %d - %s # SKIP an earlier block failed\n", i+1, name)
+		case r.Problem() != nil:
+			fmt.Fprintf(&b, "not ok %d - %s\n", i+1, name)
+			writeDiagnostics(&b, r)
+		default:
+			fmt.Fprintf(&b, "ok %d - %s\n", i+1, name)
+		}
+	}
+	_, err := io.WriteString(w, b.String())
+	return err
+}
+
+// pointName returns a name for the block's test point, giving the
+// line on which the block starts.
+func pointName(r *model.RunResult) string {
+	if r.Block().FileName() == "" || r.Block().FirstLine() < 1 {
+		return testName(r)
+	}
+	return fmt.Sprintf("@%s %s:%d", r.Block().Name(), r.Block().FileName(), r.Block().FirstLine())
+}
+
+// writeDiagnostics writes a YAML block describing a failure, using
+// literal block scalars so text needs no escaping.
+func writeDiagnostics(b *strings.Builder, r *model.RunResult) {
+	b.WriteString("  ---\n")
+	writeScalar(b, "message", firstLine(r.Problem().Error()))
+	if r.ExitCode() != model.UnknownExitCode {
+		fmt.Fprintf(b, "  exit_code: %d\n", r.ExitCode())
+	}
+	if !r.Start().IsZero() {
+		fmt.Fprintf(b, "  started: %s\n", r.Start().Format(time.RFC3339))
+	}
+	fmt.Fprintf(b, "  duration_ms: %d\n", r.Duration().Nanoseconds()/1e6)
+	writeScalar(b, "stdout", r.Output())
+	writeScalar(b, "stderr", r.Message())
+	b.WriteString("  ...\n")
+}
+
+// writeScalar writes a literal block scalar, unless value is empty.
+// Characters YAML doesn't allow, e.g. escape codes from colored
+// output, are replaced by U+FFFD.
+func writeScalar(b *strings.Builder, key, value string) {
+	value = strings.TrimRight(value, "\n")
+	if value == "" {
+		return
+	}
+	value = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' || (unicode.IsPrint(r) && r != '\uFEFF') {
+			return r
+		}
+		return unicode.ReplacementChar
+	}, value)
+	indicator := ""
+	if value[0] == ' ' || value[0] == '\t' {
+		// The indentation of the first line can't be left to guesswork.
+		indicator = "2"
+	}
+	fmt.Fprintf(b, "  %s: |%s-\n", key, indicator)
+	for _, line := range strings.Split(value, "\n") {
+		b.WriteString("    " + line + "\n")
+	}
+}
@@ -0,0 +1,49 @@
+package report
+
+import (
+	"bytes"
+	"strings"
+	"testing"
+)
+
+func TestTAP(t *testing.T) {
+	var buf bytes.Buffer
+	if err := TAP(&buf, testResults()); err != nil {
+		t.Fatal(err)
+	}
+	want := `TAP version 13
+1..3
+ok 1 - @hello a.md:3
+not ok 2 - @oops b.md:7
+  ---
+  message: |-
+    exit status 1
+  exit_code: 127
+  started: 2024-05-06T07:08:09Z
+  duration_ms: 20
+  stderr: |-
+    b.md: line 8: oops: command not found
+  ...
+ok 3 - @later b.md:12 # SKIP an earlier block failed
+`
+	if got := buf.String(); got != want {
+		t.Errorf("got\n%s\nwant\n%s", got, want)
+	}
+}
+
+func TestWriteScalar(t *testing.T) {
+	for _, c := range []struct {
+		value, want string
+	}{
+		{"", ""},
+		{"a \\x \"b\"\n", "  k: |-\n    a \\x \"b\"\n"},
+		{"  indented\nnot", "  k: |2-\n      indented\n    not\n"},
+		{"\x1b[31mred\x00", "  k: |-\n    \uFFFD[31mred\uFFFD\n"},
+	} {
+		var b strings.Builder
+		writeScalar(&b, "k", c.value)
+		if got := b.String(); got != c.want {
+			t.Errorf("%q: got %q, want %q", c.value, got, c.want)
+		}
+	}
+}
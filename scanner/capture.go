@@ -0,0 +1,142 @@
+package scanner
+
+import (
+	"bytes"
+	"fmt"
+	"unicode/utf8"
+)
+
+// DefaultMaxOutput is the most output of a block kept from each
+// stream, unless configured otherwise.
+const DefaultMaxOutput = 1 << 20
+
+// Capture accumulates a stream's output, keeping at most a given
+// number of bytes of it: the first half and the last half.  Output
+// left out of the middle is replaced by a note saying how much.  A
+// block that prints a lot, e.g. "kubectl get -o json", can't use up
+// memory, or bury a report.
+type Capture struct {
+	max     int // Zero for no limit.
+	head    bytes.Buffer
+	tail    []byte // The last bytes written, once head is full.
+	omitted int    // Bytes dropped between head and tail.
+}
+
+// NewCapture returns a Capture keeping at most max bytes, or
+// everything if max isn't positive.
+func NewCapture(max int) *Capture {
+	if max < 0 {
+		max = 0
+	}
+	return &Capture{max: max}
+}
+
+func (c *Capture) headMax() int {
+	return c.max - c.max/2
+}
+
+func (c *Capture) tailMax() int {
+	return c.max / 2
+}
+
+// WriteString adds text to the capture.
+func (c *Capture) WriteString(text string) {
+	c.write([]byte(text))
+}
+
+// write adds text to the capture, copying it, so text may be reused.
+func (c *Capture) write(text []byte) {
+	if c.max == 0 {
+		c.head.Write(text)
+		return
+	}
+	// Once the tail has begun, the head is full, even if it was left a
+	// little short so as not to split a character.
+	if room := c.headMax() - c.head.Len(); room > 0 && len(c.tail) == 0 && c.omitted == 0 {
+		if len(text) <= room {
+			c.head.Write(text)
+			return
+		}
+		// Don't split a character.
+		for room > 0 && !utf8.RuneStart(text[room]) {
+			room--
+		}
+		c.head.Write(text[:room])
+		text = text[room:]
+	}
+	c.tail = append(c.tail, text...)
+	// Trim lazily, so as not to copy the tail on every write.
+	if len(c.tail) > 2*c.tailMax() {
+		c.drop(len(c.tail) - c.tailMax())
+	}
+}
+
+// drop removes at least n bytes from the start of the tail, without
+// splitting a character.
+func (c *Capture) drop(n int) {
+	for n < len(c.tail) && !utf8.RuneStart(c.tail[n]) {
+		n++
+	}
+	c.omitted += n
+	c.tail = append(c.tail[:0], c.tail[n:]...)
+}
+
+// trim cuts the tail down to size.
+func (c *Capture) trim() {
+	if c.max > 0 && len(c.tail) > c.tailMax() {
+		c.drop(len(c.tail) - c.tailMax())
+	}
+}
+
+// String returns the output captured, with a note in place of any
+// output left out.
+func (c *Capture) String() string {
+	c.trim()
+	if c.omitted == 0 {
+		return c.head.String() + string(c.tail)
+	}
+	return c.head.String() +
+		fmt.Sprintf("\n[... mdrip omitted %d bytes of output ...]\n", c.omitted) +
+		string(c.tail)
+}
+
+// kept returns the output captured, without a note in place of any
+// output left out.
+func (c *Capture) kept() string {
+	c.trim()
+	return c.head.String() + string(c.tail)
+}
+
+// size returns the number of bytes written to the capture, including
+// those left out.
+func (c *Capture) size() int {
+	return c.head.Len() + len(c.tail) + c.omitted
+}
+
+// WriteLine adds the text of a line read by BuffScanner, without its
+// end, to the capture, counting the bytes left out of it as omitted.
+func (c *Capture) WriteLine(line Line) {
+	c.WriteString(line.Text)
+	c.omitted += line.Omitted
+}
+
+// Omitted returns the number of bytes left out of the capture.
+func (c *Capture) Omitted() int {
+	c.trim()
+	return c.omitted
+}
+
+// Reset empties the capture.
+func (c *Capture) Reset() {
+	c.head.Reset()
+	c.tail = c.tail[:0]
+	c.omitted = 0
+}
+
+// Truncate returns text cut down as a Capture keeping at most max
+// bytes would cut it.
+func Truncate(text string, max int) string {
+	c := NewCapture(max)
+	c.WriteString(text)
+	return c.String()
+}
@@ -0,0 +1,48 @@
+package scanner
+
+import (
+	"strings"
+	"testing"
+	"unicode/utf8"
+)
+
+func TestCapture(t *testing.T) {
+	tests := []struct {
+		name   string
+		max    int
+		writes []string
+		want   string
+	}{
+		{"unlimited", 0, []string{"beans\n", "rice\n"}, "beans\nrice\n"},
+		{"fits", 20, []string{"beans\n", "rice\n"}, "beans\nrice\n"},
+		{"exact", 10, []string{"0123456789"}, "0123456789"},
+		{"oneWrite", 6, []string{"0123456789"},
+			"012\n[... mdrip omitted 4 bytes of output ...]\n789"},
+		{"manyWrites", 6, []string{"01", "23", "45", "67", "89"},
+			"012\n[... mdrip omitted 4 bytes of output ...]\n789"},
+		{"longTail", 4, []string{"ab", strings.Repeat("x", 100), "yz"},
+			"ab\n[... mdrip omitted 100 bytes of output ...]\nyz"},
+		{"wholeCharacters", 4, []string{"héllo wörld"},
+			"h\n[... mdrip omitted 10 bytes of output ...]\nld"},
+	}
+	for _, test := range tests {
+		c := NewCapture(test.max)
+		for _, w := range test.writes {
+			c.WriteString(w)
+		}
+		if got := c.String(); got != test.want {
+			t.Errorf("%s: got\n\t%q\nwant\n\t%q", test.name, got, test.want)
+		}
+		if omitted := c.Omitted(); (omitted > 0) != strings.Contains(test.want, "omitted") {
+			t.Errorf("%s: got %d bytes omitted", test.name, omitted)
+		}
+		if !utf8.ValidString(c.String()) {
+			t.Errorf("%s: split a character: %q", test.name, c.String())
+		}
+		c.Reset()
+		c.WriteString("again")
+		if got := c.String(); got != Truncate("again", test.max) {
+			t.Errorf("%s: after reset got %q", test.name, got)
+		}
+	}
+}
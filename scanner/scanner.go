@@ -2,59 +2,155 @@ package scanner
 
 import (
 	"bufio"
+	"crypto/rand"
+	"encoding/hex"
 	"github.com/golang/glog"
 	"io"
+	"strings"
 	"time"
 )
 
 // Special strings that might appear in shell output, signalling
-// things to the stream processors.
+// things to the stream processors.  In output they're always followed
+// by a run's nonce (see Sentinels); alone, they're only used in
+// messages.
 const MsgHappy = "MDRIP_HAPPY_Completed_command_block"
 const MsgError = "MDRIP_ERROR_Problem_while_executing_command_block"
 const MsgTimeout = "MDRIP_TIMEOUT_Command_block_did_not_finish_in_allotted_time"
+const MsgStart = "MDRIP_START_Running_command_block"
+const MsgCleanup = "MDRIP_CLEANUP_Running_cleanup_block"
+const MsgCleanupDone = "MDRIP_CLEANUP_Finished_cleanup_block_with_status"
+
+// Sentinels holds the special strings for one run, each being one of
+// the Msg constants followed by a secret nonce.  A block can print the
+// constants, e.g. by catting a log or mdrip's own source, but can't
+// guess the secret, so can't fake a block's completion.  Scripts
+// mustn't hold the secret, lest a block print it by catting the
+// script, so the shell is given it apart from its script.
+type Sentinels struct {
+	Happy       string
+	Error       string
+	Timeout     string
+	Start       string
+	Cleanup     string
+	CleanupDone string
+	Secret      string // The nonce in the sentinels.
+	Nonce       string // Another nonce, for markers written in scripts, e.g. ending here documents.
+}
+
+// NewSentinels returns sentinels with a fresh secret and nonce.
+func NewSentinels() *Sentinels {
+	secret, nonce := newNonce(), newNonce()
+	return &Sentinels{
+		MsgHappy + "_" + secret,
+		MsgError + "_" + secret,
+		MsgTimeout + "_" + secret,
+		MsgStart + "_" + secret,
+		MsgCleanup + "_" + secret,
+		MsgCleanupDone + "_" + secret,
+		secret,
+		nonce}
+}
+
+func newNonce() string {
+	b := make([]byte, 16)
+	if _, err := rand.Read(b); err != nil {
+		glog.Fatalf("Unable to make a nonce: %v", err)
+	}
+	return hex.EncodeToString(b)
+}
+
+// Strip returns the given text with the nonce removed from any
+// sentinels in it, for showing to users.
+func (s *Sentinels) Strip(text string) string {
+	return strings.NewReplacer(
+		s.Happy, MsgHappy,
+		s.Error, MsgError,
+		s.Timeout, MsgTimeout,
+		s.Start, MsgStart,
+		s.Cleanup, MsgCleanup,
+		s.CleanupDone, MsgCleanupDone).Replace(text)
+}
+
+// cleanLine drops the end of a line, including any carriage return,
+// and replaces bytes that aren't UTF-8, e.g. from binary output, so
+// that the line can go in any report.
+func cleanLine(line string) string {
+	line = strings.TrimSuffix(line, "\n")
+	line = strings.TrimSuffix(line, "\r")
+	return strings.ToValidUTF8(line, "\uFFFD")
+}
+
+// chunkSize is the most of a line read from a stream at once.
+const chunkSize = 64 * 1024
+
+// Line is a line of text from a stream, without its end.  A line too
+// long to keep whole has its middle left out.
+type Line struct {
+	Text    string
+	Omitted int // Bytes left out of the middle of Text.
+}
 
 // BuffScanner returns a channel to which it will write lines of text.
 //
 // The text is harvested from an io stream, which will be read until
 // the io stream hits EOF or otherwise closes - at which point the
-// returned channel is closed.
+// returned channel is closed.  Lines may be of any length, and bytes
+// that aren't UTF-8 are replaced by U+FFFD.  Lines are read a piece at
+// a time, keeping the first and last max bytes of a longer line, or
+// all of it if max is zero, so a stream without line ends, e.g. of
+// minified JSON or binary data, can't use up memory.  As a Capture
+// keeping max bytes keeps no more of the line than that, it captures
+// the same output as it would from the whole line, if told how much
+// was left out.
 //
 // If the io stream blocks for longer than the given wait time, the
-// function will send a special line of text to the channel and close
-// it.
-func BuffScanner(wait time.Duration, label string, stream io.ReadCloser) <-chan string {
-	chLine := make(chan string, 1)
+// function will send the timeout sentinel to the channel and close
+// it.  A read error is sent as the error sentinel followed by the
+// error.
+func BuffScanner(
+	wait time.Duration, label string, stream io.ReadCloser, max int, s *Sentinels) <-chan Line {
+	chLine := make(chan Line, 1)
 
-	xScanner := func() <-chan string {
-		chBuffLine := make(chan string, 1)
+	xScanner := func() <-chan Line {
+		chBuffLine := make(chan Line, 1)
 		go func() {
 			defer close(chBuffLine)
-			scanner := bufio.NewScanner(stream)
+			reader := bufio.NewReaderSize(stream, chunkSize)
+			if max > 0 && max < chunkSize {
+				max = chunkSize
+			}
+			line := NewCapture(2 * max)
 			if glog.V(2) {
 				glog.Info("xScanner: %s - starting up", label)
 			}
-			for scanner.Scan() {
-				if glog.V(2) {
-					glog.Info("xScanner: %s - calling Text", label)
+			for {
+				piece, err := reader.ReadSlice('\n')
+				line.write(piece)
+				if err == bufio.ErrBufferFull {
+					continue
 				}
-				line := scanner.Text()
-				if glog.V(2) {
-					glog.Info("xScanner: %s - got \"%s\"", label, line)
+				if line.size() > 0 {
+					text := Line{cleanLine(line.kept()), line.Omitted()}
+					line.Reset()
+					if glog.V(2) {
+						glog.Info("xScanner: %s - got \"%s\"", label, text.Text)
+					}
+					chBuffLine <- text
+					if glog.V(2) {
+						glog.Info("xScanner: %s - handed \"%s\" to channel", label, text.Text)
+					}
 				}
-				chBuffLine <- line
-				if glog.V(2) {
-					glog.Info("xScanner: %s - handed \"%s\" to channel", label, line)
+				if err == io.EOF {
+					break
 				}
-			}
-
-			if glog.V(2) {
-				glog.Info("xScanner: %s - exitted Scan loop", label)
-			}
-			if err := scanner.Err(); err != nil {
-				if glog.V(2) {
-					glog.Info("xScanner: %s - error : %s", label, err.Error())
+				if err != nil {
+					if glog.V(2) {
+						glog.Info("xScanner: %s - error : %s", label, err.Error())
+					}
+					chBuffLine <- Line{Text: s.Error + " : " + err.Error()}
+					break
 				}
-				chBuffLine <- MsgError + " : " + err.Error()
 			}
 			if glog.V(2) {
 				glog.Info("xScanner: %s - completely done", label)
@@ -89,7 +185,7 @@ func BuffScanner(wait time.Duration, label string, stream io.ReadCloser) <-chan
 					return
 				}
 			case <-time.After(wait):
-				chLine <- MsgTimeout
+				chLine <- Line{Text: s.Timeout}
 				if glog.V(2) {
 					glog.Info("buffScanner: %s - timed out", label)
 				}
@@ -4,6 +4,7 @@ import (
 	"bytes"
 	"fmt"
 	"io"
+	"strings"
 	"testing"
 	"time"
 )
@@ -20,14 +21,15 @@ func (stalledReader) Close() error { return nil }
 
 func TestStalledReader(t *testing.T) {
 	foo := stalledReader{}
-	chOut := BuffScanner(1*time.Second, "heythere", foo)
+	s := NewSentinels()
+	chOut := BuffScanner(1*time.Second, "heythere", foo, 0, s)
 
 	line, ok := <-chOut
 	if !ok {
 		t.Fail()
 	}
-	want := MsgTimeout
-	if line != want {
+	want := s.Timeout
+	if line.Text != want {
 		t.Errorf("got \n\t%v\nwant\n\t%v", line, want)
 	}
 
@@ -49,14 +51,15 @@ func (bustedReader) Close() error { return nil }
 
 func TestBustedReader(t *testing.T) {
 	foo := bustedReader{}
-	chOut := BuffScanner(1*time.Second, "heythere", foo)
+	s := NewSentinels()
+	chOut := BuffScanner(1*time.Second, "heythere", foo, 0, s)
 
 	line, ok := <-chOut
 	if !ok {
 		t.Fail()
 	}
-	want := MsgError + " : multiple Read calls return no data or error"
-	if line != want {
+	want := s.Error + " : multiple Read calls return no data or error"
+	if line.Text != want {
 		t.Errorf("got \n\t%v\nwant\n\t%v", line, want)
 	}
 
@@ -74,14 +77,14 @@ func (simpleReader) Close() error { return nil }
 
 func TestSimpleReader(t *testing.T) {
 	foo1 := simpleReader{bytes.NewBufferString("beans and\nrice")}
-	chOut := BuffScanner(1*time.Second, "heythere", foo1)
+	chOut := BuffScanner(1*time.Second, "heythere", foo1, 0, NewSentinels())
 
 	line, ok := <-chOut
 	if !ok {
 		t.Fail()
 	}
 	want := "beans and"
-	if line != want {
+	if line.Text != want {
 		t.Errorf("got \n\t%v\nwant\n\t%v", line, want)
 	}
 
@@ -90,7 +93,7 @@ func TestSimpleReader(t *testing.T) {
 		t.Fail()
 	}
 	want = "rice"
-	if line != want {
+	if line.Text != want {
 		t.Errorf("got \n\t%v\nwant\n\t%v", line, want)
 	}
 
@@ -100,29 +103,85 @@ func TestSimpleReader(t *testing.T) {
 	}
 }
 
+// endlessLine is a reader of one line, with no end, of n bytes.
+type endlessLine struct {
+	n int
+}
+
+func (r *endlessLine) Read(p []byte) (int, error) {
+	if r.n == 0 {
+		return 0, io.EOF
+	}
+	if len(p) > r.n {
+		p = p[:r.n]
+	}
+	for i := range p {
+		p[i] = 'x'
+	}
+	r.n -= len(p)
+	return len(p), nil
+}
+
+func (*endlessLine) Close() error { return nil }
+
+func TestLongLine(t *testing.T) {
+	n := 8 << 20
+	chOut := BuffScanner(1*time.Second, "heythere", &endlessLine{n}, 1000, NewSentinels())
+	line, ok := <-chOut
+	if !ok {
+		t.Fatal("expected a line")
+	}
+	// Lines keep at least a chunk from each end.
+	if line.Text != strings.Repeat("x", 2*chunkSize) || line.Omitted != n-2*chunkSize {
+		t.Errorf("got %d bytes with %d omitted, want %d with %d omitted",
+			len(line.Text), line.Omitted, 2*chunkSize, n-2*chunkSize)
+	}
+	c := NewCapture(1000)
+	c.WriteLine(line)
+	if c.Omitted() != n-1000 {
+		t.Errorf("capture omitted %d bytes, want %d", c.Omitted(), n-1000)
+	}
+	if _, ok = <-chOut; ok {
+		t.Errorf("expected the channel to close")
+	}
+}
+
+func TestNewSentinels(t *testing.T) {
+	s1, s2 := NewSentinels(), NewSentinels()
+	if !strings.HasPrefix(s1.Happy, MsgHappy+"_") || len(s1.Happy) <= len(MsgHappy)+1 {
+		t.Errorf("got %q, want %s and a nonce", s1.Happy, MsgHappy)
+	}
+	if s1.Happy == s2.Happy || s1.Timeout == s2.Timeout {
+		t.Errorf("runs share a nonce: %q, %q", s1.Happy, s2.Happy)
+	}
+	if s1.Happy != MsgHappy+"_"+s1.Secret || strings.Contains(s1.Happy, s1.Nonce) {
+		t.Errorf("expected the secret, not the nonce, in %q", s1.Happy)
+	}
+}
+
 // An example main.
 func main() {
 	{
 		foo := simpleReader{bytes.NewBufferString("beans and\nrice")}
-		chOut := BuffScanner(1*time.Second, "heythere", foo)
+		chOut := BuffScanner(1*time.Second, "heythere", foo, 0, NewSentinels())
 		for line := range chOut {
-			fmt.Println(line)
+			fmt.Println(line.Text)
 		}
 		fmt.Println("-----------------------")
 	}
 	{
 		foo := stalledReader{}
-		chOut := BuffScanner(1*time.Second, "heythere", foo)
+		chOut := BuffScanner(1*time.Second, "heythere", foo, 0, NewSentinels())
 		for line := range chOut {
-			fmt.Println(line)
+			fmt.Println(line.Text)
 		}
 		fmt.Println("-----------------------")
 	}
 	{
 		foo := bustedReader{}
-		chOut := BuffScanner(1*time.Second, "heythere", foo)
+		chOut := BuffScanner(1*time.Second, "heythere", foo, 0, NewSentinels())
 		for line := range chOut {
-			fmt.Println(line)
+			fmt.Println(line.Text)
 		}
 		fmt.Println("-----------------------")
 	}
@@ -5,6 +5,8 @@ import (
 	"io/ioutil"
 	"os"
 	"os/exec"
+	"strings"
+	"sync"
 
 	"github.com/golang/glog"
 )
@@ -12,6 +14,8 @@ import (
 type Tmux struct {
 	programName string
 	paneId      string
+	mu          sync.Mutex        // Guards panes.
+	panes       map[string]string // Pane ids of named shells.
 }
 
 const (
@@ -20,7 +24,7 @@ const (
 )
 
 func NewTmux(programName string) *Tmux {
-	return &Tmux{programName, "0"}
+	return &Tmux{programName: programName, paneId: "0", panes: map[string]string{}}
 }
 
 func IsProgramInstalled(programName string) bool {
@@ -28,7 +32,7 @@ func IsProgramInstalled(programName string) bool {
 	return err == nil
 }
 
-func (t Tmux) Refresh() error {
+func (t *Tmux) Refresh() error {
 	_, err := exec.LookPath(t.programName)
 	if err != nil {
 		fmt.Printf("Unable to find %s: %v\n", t.programName, err)
@@ -51,7 +55,51 @@ func (t Tmux) Refresh() error {
 //  like use-behavior.  yay tmux.
 //
 // TODO: look for a better tmux api (dbus?)
-func (t Tmux) Write(bytes []byte) (n int, err error) {
+func (t *Tmux) Write(bytes []byte) (n int, err error) {
+	return t.writeToPane(t.paneId, bytes)
+}
+
+// WriteToShell writes bytes to the pane of the named shell, splitting
+// a new pane off the session's window the first time the shell is
+// named.  The unnamed shell is the original pane.
+func (t *Tmux) WriteToShell(shell string, bytes []byte) (n int, err error) {
+	pane, err := t.pane(shell)
+	if err != nil {
+		return 0, err
+	}
+	return t.writeToPane(pane, bytes)
+}
+
+// pane returns the id of the named shell's pane, creating it if need
+// be.  Blocks may be written from concurrent requests, so a shell's
+// pane is looked up and created as one step.
+func (t *Tmux) pane(shell string) (string, error) {
+	if shell == "" {
+		return t.paneId, nil
+	}
+	t.mu.Lock()
+	defer t.mu.Unlock()
+	if id, ok := t.panes[shell]; ok {
+		return id, nil
+	}
+	cmd := exec.Command(t.programName,
+		"split-window", "-d", "-t", SessionName, "-P", "-F", "#{pane_id}")
+	out, err := cmd.Output()
+	if err != nil {
+		glog.Info("cmd = ", cmd.Args)
+		return "", err
+	}
+	id := strings.TrimSpace(string(out))
+	// Title the pane after its shell, and share the window evenly.
+	// Failures here are cosmetic.
+	exec.Command(t.programName, "select-pane", "-t", id, "-T", shell).Run()
+	exec.Command(t.programName, "select-layout", "-t", SessionName, "tiled").Run()
+	t.panes[shell] = id
+	glog.Info("Shell ", shell, " is pane ", id)
+	return id, nil
+}
+
+func (t *Tmux) writeToPane(paneId string, bytes []byte) (n int, err error) {
 	tmpFile, err := ioutil.TempFile("", "mdrip-block-")
 	check("create temp file", err)
 	check("chmod temp file", os.Chmod(tmpFile.Name(), 0644))
@@ -71,7 +119,7 @@ func (t Tmux) Write(bytes []byte) (n int, err error) {
 	cmd := exec.Command(t.programName, "load-buffer", tmpFile.Name())
 	out, err := cmd.Output()
 	if err == nil {
-		cmd = exec.Command(t.programName, "paste-buffer", "-t", t.paneId)
+		cmd = exec.Command(t.programName, "paste-buffer", "-t", paneId)
 		out, err = cmd.Output()
 	}
 
@@ -82,21 +130,21 @@ func (t Tmux) Write(bytes []byte) (n int, err error) {
 	return len(bytes), err
 }
 
-func (t Tmux) Start() error {
+func (t *Tmux) Start() error {
 	cmd := exec.Command(t.programName, "new", "-s", SessionName, "-d")
 	out, err := cmd.Output()
 	glog.Info("Starting ", out)
 	return err
 }
 
-func (t Tmux) Stop() error {
+func (t *Tmux) Stop() error {
 	cmd := exec.Command(t.programName, "kill-session", "-t", SessionName)
 	out, err := cmd.Output()
 	glog.Info("Stopping ", out)
 	return err
 }
 
-func (t Tmux) ListSessions() (string, error) {
+func (t *Tmux) ListSessions() (string, error) {
 	cmd := exec.Command(t.programName, "list-sessions")
 	raw, err := cmd.Output()
 	glog.Info("List ", string(raw))
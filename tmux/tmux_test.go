@@ -3,7 +3,12 @@ package tmux
 // go test -v github.com/monopole/mdrip/tmux --alsologtostderr
 
 import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
 	"strings"
+	"sync"
 	"testing"
 )
 
@@ -62,3 +67,67 @@ func TestStartAndStopTmuxSession(t *testing.T) {
 		t.Errorf("unable to stop session: %s", err)
 	}
 }
+
+func TestWriteToShell(t *testing.T) {
+	if shouldSkip {
+		t.Skip(skipMessage)
+	}
+	x := NewTmux(ProgramName)
+	if err := x.Start(); err != nil {
+		t.Fatalf("unable to start session: %s", err)
+	}
+	defer x.Stop()
+	for _, shell := range []string{"server", "client", "server"} {
+		if _, err := x.WriteToShell(shell, []byte("true\n")); err != nil {
+			t.Fatalf("unable to write to shell %s: %s", shell, err)
+		}
+	}
+	out, err := exec.Command(ProgramName, "list-panes", "-t", SessionName).Output()
+	if err != nil {
+		t.Fatalf("unable to list panes: %s", err)
+	}
+	if n := strings.Count(string(out), "\n"); n != 3 {
+		t.Errorf("expected 3 panes, got %d:\n%s", n, out)
+	}
+}
+
+func TestConcurrentPanes(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mdrip-tmux-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	// A fake tmux, counting the panes it splits off.
+	fake := filepath.Join(dir, "tmux")
+	script := "#!/bin/sh\n" +
+		"if [ \"$1\" = split-window ]; then echo x >>" + dir + "/splits; echo %$$; fi\n"
+	if err := ioutil.WriteFile(fake, []byte(script), 0755); err != nil {
+		t.Fatal(err)
+	}
+	x := NewTmux(fake)
+	var wg sync.WaitGroup
+	ids := make([]string, 20)
+	for i := range ids {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			shell := []string{"server", "client"}[i%2]
+			id, err := x.pane(shell)
+			if err != nil {
+				t.Errorf("unable to make pane for %s: %v", shell, err)
+			}
+			ids[i] = id
+		}(i)
+	}
+	wg.Wait()
+	splits, _ := ioutil.ReadFile(filepath.Join(dir, "splits"))
+	if n := strings.Count(string(splits), "x"); n != 2 {
+		t.Errorf("expected 2 panes split off, got %d", n)
+	}
+	for i := range ids {
+		if ids[i] != ids[i%2] {
+			t.Errorf("expected one pane per shell, got %v", ids)
+			break
+		}
+	}
+}
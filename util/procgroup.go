@@ -0,0 +1,13 @@
+package util
+
+import "fmt"
+
+// Process describes a member of a process group.
+type Process struct {
+	Pid     int
+	Command string
+}
+
+func (p Process) String() string {
+	return fmt.Sprintf("%d %s", p.Pid, p.Command)
+}
@@ -0,0 +1,44 @@
+package util
+
+import (
+	"io/ioutil"
+	"strconv"
+	"strings"
+)
+
+// groupMembers returns the live (i.e. not zombie) processes in the
+// given group, found by scanning /proc.
+func groupMembers(pgid int) []Process {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil
+	}
+	result := []Process{}
+	for _, e := range entries {
+		pid, err := strconv.Atoi(e.Name())
+		if err != nil {
+			continue
+		}
+		stat, err := ioutil.ReadFile("/proc/" + e.Name() + "/stat")
+		if err != nil {
+			continue // Gone already.
+		}
+		// The command name is parenthesized, and may hold spaces, so
+		// fields are counted from the last paren.
+		s := string(stat)
+		i := strings.LastIndex(s, ")")
+		if i < 0 {
+			continue
+		}
+		fields := strings.Fields(s[i+1:])
+		if len(fields) < 3 || fields[0] == "Z" || fields[2] != strconv.Itoa(pgid) {
+			continue
+		}
+		command := s[strings.Index(s, "(")+1 : i]
+		if cmdline, err := ioutil.ReadFile("/proc/" + e.Name() + "/cmdline"); err == nil && len(cmdline) > 0 {
+			command = strings.TrimSpace(strings.Replace(string(cmdline), "\x00", " ", -1))
+		}
+		result = append(result, Process{pid, command})
+	}
+	return result
+}
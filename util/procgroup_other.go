@@ -0,0 +1,30 @@
+//go:build !unix
+
+package util
+
+import (
+	"os"
+	"syscall"
+	"time"
+)
+
+// NewGroupAttr returns no special attributes, as there are no process
+// groups to start a command in.
+func NewGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{}
+}
+
+// KillProcessGroup kills the process with the given id, which leads
+// the group on unix, at once, since there's no TERM to send first.
+// Processes it started are left running.  It returns the process, if
+// it was running when called.
+func KillProcessGroup(pgid int, grace time.Duration) []Process {
+	proc, err := os.FindProcess(pgid)
+	if err != nil {
+		return nil
+	}
+	if proc.Kill() != nil {
+		return nil // Gone already.
+	}
+	return []Process{{pgid, "(process)"}}
+}
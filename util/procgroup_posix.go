@@ -0,0 +1,15 @@
+//go:build unix && !linux
+
+package util
+
+import "syscall"
+
+// groupMembers returns a stand-in for the processes in the given
+// group, if it has any.  Without /proc there's no cheap way to list
+// them, and zombies count as members.
+func groupMembers(pgid int) []Process {
+	if syscall.Kill(-pgid, 0) != nil {
+		return nil
+	}
+	return []Process{{pgid, "(process group)"}}
+}
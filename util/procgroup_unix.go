@@ -0,0 +1,38 @@
+//go:build unix
+
+package util
+
+import (
+	"syscall"
+	"time"
+)
+
+// NewGroupAttr returns attributes that start a command as the leader
+// of a new process group, whose id is then the command's pid, so
+// that the command and everything it starts can be signalled at once.
+//
+// Goal is to be able to kill any subprocesses created by
+// RunInSubShell, rather than leave it up to command script authors
+// to clean up after themselves.
+func NewGroupAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setpgid: true}
+}
+
+// KillProcessGroup stops every process in the given group, sending
+// TERM, then KILL to any still running after the grace period.  It
+// returns the processes that were running when it was called.
+func KillProcessGroup(pgid int, grace time.Duration) []Process {
+	running := groupMembers(pgid)
+	if len(running) == 0 {
+		return nil
+	}
+	syscall.Kill(-pgid, syscall.SIGTERM)
+	for deadline := time.Now().Add(grace); time.Now().Before(deadline); {
+		if len(groupMembers(pgid)) == 0 {
+			return running
+		}
+		time.Sleep(50 * time.Millisecond)
+	}
+	syscall.Kill(-pgid, syscall.SIGKILL)
+	return running
+}